@@ -6,6 +6,7 @@ require (
 	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
 	github.com/gin-gonic/gin v1.10.0
 	github.com/gobwas/glob v0.2.3
+	github.com/gorilla/websocket v1.5.3
 	github.com/graphql-go/graphql v0.8.1
 	github.com/lestrrat-go/jwx/v2 v2.1.1
 	github.com/patrickmn/go-cache v2.1.0+incompatible
@@ -14,6 +14,7 @@ func main() {
 		fx.Provide(config.NewConfig),
 		fx.Provide(cache.NewCache),
 		modules.Repository,
+		modules.Upstream,
 		modules.Service,
 		modules.Handler,
 		modules.Server,
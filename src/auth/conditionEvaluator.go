@@ -8,6 +8,8 @@ import (
 	"github.com/graphql-iam/agent/src/model"
 	"net"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,84 +21,181 @@ type ConditionEvaluator struct {
 	variables map[string]interface{}
 	query     string
 	claims    map[string]interface{}
+	arguments map[string]interface{}
+	metrics   QueryMetrics
 }
 
 func (ce *ConditionEvaluator) Evaluate() bool {
-	for key, value := range ce.condition {
-		res := false
-		switch key {
-		case "StringEquals":
-			res = ce.stringEquals(value)
-			break
-		case "StringNotEquals":
-			res = ce.stringNotEquals(value)
-			break
-		case "StringEqualsIgnoreCase":
-			res = ce.stringEqualsIgnoreCase(value)
-			break
-		case "StringNotEqualsIgnoreCase":
-			res = ce.stringNotEqualsIgnoreCase(value)
-			break
-		case "StringLike":
-			res = ce.stringLike(value)
-			break
-		case "StringNotLike":
-			res = ce.stringNotLike(value)
-			break
-		case "DateEquals":
-			res = ce.dateEquals(value)
-			break
-		case "DateNotEquals":
-			res = ce.dateNotEquals(value)
-			break
-		case "DateLessThan":
-			res = ce.dateLessThan(value)
-			break
-		case "DateLessThanEquals":
-			res = ce.dateLessThanEquals(value)
-			break
-		case "DateGreaterThan":
-			res = ce.dateGreaterThan(value)
-			break
-		case "DateGreaterThanEquals":
-			res = ce.dateGreaterThanEquals(value)
-			break
-		case "NumericEquals":
-			res = ce.numericEquals(value)
-			break
-		case "NumericLessThan":
-			res = ce.numericLessThan(value)
-			break
-		case "NumericLessThanEquals":
-			res = ce.numericLessThanEquals(value)
-			break
-		case "NumericGreaterThan":
-			res = ce.numericGreaterThan(value)
-			break
-		case "NumericGreaterThanEquals":
-			res = ce.numericGreaterThanEquals(value)
-			break
-		case "Bool":
-			res = ce.bool_(value)
-			break
-		case "Null":
-			res = ce.null_(value)
-			break
-		case "IpAddress":
-			res = ce.ipAddress(value)
-			break
-		case "NotIpAddress":
-			res = ce.notIpAddress(value)
-			break
+	return len(ce.failedOperators()) == 0
+}
+
+// failedOperators evaluates every operator of the condition and returns the ones that are not met.
+func (ce *ConditionEvaluator) failedOperators() []string {
+	var failed []string
+	for operator, params := range ce.condition {
+		if !ce.evaluateOperator(operator, params) {
+			failed = append(failed, operator)
 		}
-		if !res {
-			return false
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// unresolvedOperators returns the operators of the condition whose policy variables can't be resolved.
+func (ce *ConditionEvaluator) unresolvedOperators() []string {
+	var unresolved []string
+	for operator, params := range ce.condition {
+		if _, err := ce.substituteParams(operator, params); err != nil {
+			unresolved = append(unresolved, operator)
+		}
+	}
+	sort.Strings(unresolved)
+	return unresolved
+}
+
+const (
+	forAnyValue  = "ForAnyValue:"
+	forAllValues = "ForAllValues:"
+	ifExists     = "IfExists"
+)
+
+// conditionOperator compares a single receiver value with a single condition value. Negated operators
+// are met if the receiver matches none of the values, the others if it matches any of them.
+// An error means the receiver or the value can't be compared, which fails the operator.
+type conditionOperator struct {
+	compare func(receiver interface{}, value string) (bool, error)
+	negated bool
+}
+
+var conditionOperators = map[string]conditionOperator{
+	"StringEquals":              {compare: stringEquals},
+	"StringNotEquals":           {compare: stringEquals, negated: true},
+	"StringEqualsIgnoreCase":    {compare: stringEqualsIgnoreCase},
+	"StringNotEqualsIgnoreCase": {compare: stringEqualsIgnoreCase, negated: true},
+	"StringLike":                {compare: stringLike},
+	"StringNotLike":             {compare: stringLike, negated: true},
+	"DateEquals":                {compare: compareDates(func(r, v time.Time) bool { return r.Equal(v) })},
+	"DateNotEquals":             {compare: compareDates(func(r, v time.Time) bool { return r.Equal(v) }), negated: true},
+	"DateLessThan":              {compare: compareDates(func(r, v time.Time) bool { return r.Before(v) })},
+	"DateLessThanEquals":        {compare: compareDates(func(r, v time.Time) bool { return !r.After(v) })},
+	"DateGreaterThan":           {compare: compareDates(func(r, v time.Time) bool { return r.After(v) })},
+	"DateGreaterThanEquals":     {compare: compareDates(func(r, v time.Time) bool { return !r.Before(v) })},
+	"NumericEquals":             {compare: compareNumbers(func(r, v float64) bool { return r == v })},
+	"NumericLessThan":           {compare: compareNumbers(func(r, v float64) bool { return r < v })},
+	"NumericLessThanEquals":     {compare: compareNumbers(func(r, v float64) bool { return r <= v })},
+	"NumericGreaterThan":        {compare: compareNumbers(func(r, v float64) bool { return r > v })},
+	"NumericGreaterThanEquals":  {compare: compareNumbers(func(r, v float64) bool { return r >= v })},
+	"Bool":                      {compare: boolEquals},
+	"IpAddress":                 {compare: ipAddress},
+	"NotIpAddress":              {compare: ipAddress, negated: true},
+}
+
+// evaluateOperator evaluates an operator like StringEquals, optionally prefixed with ForAnyValue: or
+// ForAllValues: for receivers holding a list and suffixed with IfExists to ignore missing receivers.
+// Without a prefix receivers holding a list fail the operator. ForAnyValue: is met if any value of
+// the receiver matches, ForAllValues: if every value does, which includes missing receivers.
+func (ce *ConditionEvaluator) evaluateOperator(operator string, params model.ConditionParams) bool {
+	qualifier := ""
+	for _, prefix := range []string{forAnyValue, forAllValues} {
+		if strings.HasPrefix(operator, prefix) {
+			qualifier, operator = prefix, strings.TrimPrefix(operator, prefix)
 		}
 	}
+	operator, skipMissing := strings.CutSuffix(operator, ifExists)
+
+	params, err := ce.substituteParams(operator, params)
+	if err != nil {
+		return false
+	}
+
+	if operator == "Null" {
+		return qualifier == "" && !skipMissing && ce.null_(params)
+	}
+	op, ok := conditionOperators[operator]
+	if !ok {
+		return false
+	}
 
+	for key, values := range params {
+		receiver, err := ce.resolveMatchingReceiver(key)
+		if err != nil {
+			return false
+		}
+		if receiver == nil && skipMissing {
+			continue
+		}
+
+		switch qualifier {
+		case forAnyValue:
+			if !slices.ContainsFunc(receiverValues(receiver), func(r interface{}) bool { return op.match(r, values) }) {
+				return false
+			}
+		case forAllValues:
+			for _, r := range receiverValues(receiver) {
+				if !op.match(r, values) {
+					return false
+				}
+			}
+		default:
+			if _, isList := receiver.([]interface{}); isList || !op.match(receiver, values) {
+				return false
+			}
+		}
+	}
 	return true
 }
 
+// match compares a single receiver value with all values of a condition key.
+func (op conditionOperator) match(receiver interface{}, values model.ConditionValues) bool {
+	for _, value := range values {
+		matched, err := op.compare(receiver, value)
+		if err != nil {
+			return false
+		}
+		if matched {
+			return !op.negated
+		}
+	}
+	return op.negated
+}
+
+// receiverValues returns the values of a receiver holding a list, a single value as a list of one
+// and no values for a missing receiver.
+func receiverValues(receiver interface{}) []interface{} {
+	switch r := receiver.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return r
+	case []string:
+		values := make([]interface{}, len(r))
+		for i, value := range r {
+			values[i] = value
+		}
+		return values
+	}
+	return []interface{}{receiver}
+}
+
+// substituteParams fills the policy variables of the condition values, escaped for the glob
+// patterns of StringLike and StringNotLike.
+func (ce *ConditionEvaluator) substituteParams(operator string, params model.ConditionParams) (model.ConditionParams, error) {
+	escape := escapeLiteral
+	if operator == "StringLike" || operator == "StringNotLike" {
+		escape = escapeGlob
+	}
+
+	result := make(model.ConditionParams, len(params))
+	for key, values := range params {
+		substituted, err := ce.substituteAll(values, escape)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = substituted
+	}
+	return result, nil
+}
+
 func (ce *ConditionEvaluator) resolveMatchingReceiver(receiverStr string) (interface{}, error) {
 	before, after, found := strings.Cut(receiverStr, ":")
 	if !found {
@@ -104,6 +203,9 @@ func (ce *ConditionEvaluator) resolveMatchingReceiver(receiverStr string) (inter
 	}
 	switch before {
 	case "header":
+		if len(ce.request.Header.Values(after)) == 0 {
+			return nil, nil
+		}
 		return ce.request.Header.Get(after), nil
 	case "var":
 		return ce.variables[after], nil
@@ -113,6 +215,12 @@ func (ce *ConditionEvaluator) resolveMatchingReceiver(receiverStr string) (inter
 		return getHttpMatchingReceiverValue(after, ce.request)
 	case "meta":
 		return getMetaMatchingReceiverValue(after)
+	case "arg":
+		return getArgumentMatchingReceiverValue(after, ce.arguments), nil
+	case "query":
+		if value, ok := ce.metrics.value(after); ok {
+			return value, nil
+		}
 	}
 	return nil, errors.New(fmt.Sprintf("condition receiver %s is invalid", receiverStr))
 }
@@ -149,256 +257,80 @@ func getMetaMatchingReceiverValue(key string) (interface{}, error) {
 	return nil, errors.New("could not resolve meta matching receiver")
 }
 
-func (ce *ConditionEvaluator) stringEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		if value != receiver {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) stringNotEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		if value == receiver {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) stringEqualsIgnoreCase(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
+// getArgumentMatchingReceiverValue resolves keys like user.id to the argument id of the field user.
+// Keys may continue into input objects, e.g. users.filter.role. Arguments of fields the resource
+// is not selected in are nil.
+func getArgumentMatchingReceiverValue(key string, arguments map[string]interface{}) interface{} {
+	segments := strings.Split(key, ".")
+	for i := len(segments); i > 0; i-- {
+		value, ok := arguments[strings.Join(segments[:i], ".")]
 		if !ok {
-			return false
+			continue
 		}
-
-		if !strings.EqualFold(value, receiver) {
-			return false
+		for _, segment := range segments[i:] {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = object[segment]
 		}
+		return value
 	}
-	return true
+	return nil
 }
 
-func (ce *ConditionEvaluator) stringNotEqualsIgnoreCase(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		// double negation to keep consistency
-		// negate wanted condition for better readability
-		if strings.EqualFold(value, receiver) {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) stringLike(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		g, err := glob.Compile(value)
-		if err != nil {
-			return false
-		}
-
-		if !g.Match(receiver) {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) stringNotLike(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		g, err := glob.Compile(value)
-		if err != nil {
-			return false
-		}
-
-		if g.Match(receiver) {
-			return false
-		}
+// receiverString returns the receiver as compared by the string operators. Numbers are compared
+// by their text, since an ID argument may be written as a number as well as a string.
+func receiverString(receiver interface{}) (string, error) {
+	switch r := receiver.(type) {
+	case string:
+		return r, nil
+	case int, int64, float64:
+		return policyVariableText(r)
 	}
-	return true
+	return "", errors.New("receiver is not a string")
 }
 
-func (ce *ConditionEvaluator) dateEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		compareWith, err := dateparse.ParseAny(value)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || !receiver.Equal(compareWith) {
-			return false
-		}
+func stringEquals(receiver interface{}, value string) (bool, error) {
+	r, err := receiverString(receiver)
+	if err != nil {
+		return false, err
 	}
-	return true
+	return r == value, nil
 }
 
-func (ce *ConditionEvaluator) dateNotEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		compareWith, err := dateparse.ParseAny(value)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || receiver.Equal(compareWith) {
-			return false
-		}
+func stringEqualsIgnoreCase(receiver interface{}, value string) (bool, error) {
+	r, err := receiverString(receiver)
+	if err != nil {
+		return false, err
 	}
-	return true
+	return strings.EqualFold(r, value), nil
 }
 
-func (ce *ConditionEvaluator) dateLessThan(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		compareWith, err := dateparse.ParseAny(value)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || !receiver.Before(compareWith) {
-			return false
-		}
+func stringLike(receiver interface{}, value string) (bool, error) {
+	r, err := receiverString(receiver)
+	if err != nil {
+		return false, err
 	}
-	return true
-}
-
-func (ce *ConditionEvaluator) dateLessThanEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		compareWith, err := dateparse.ParseAny(value)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || !(receiver.Equal(compareWith) || receiver.Before(compareWith)) {
-			return false
-		}
+	g, err := glob.Compile(value)
+	if err != nil {
+		return false, err
 	}
-	return true
+	return g.Match(r), nil
 }
 
-func (ce *ConditionEvaluator) dateGreaterThan(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
+func compareDates(compare func(receiver time.Time, value time.Time) bool) func(interface{}, string) (bool, error) {
+	return func(receiverInterface interface{}, value string) (bool, error) {
 		compareWith, err := dateparse.ParseAny(value)
 		if err != nil {
-			return false
+			return false, err
 		}
-
 		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || !receiver.After(compareWith) {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) dateGreaterThanEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
 		if err != nil {
-			return false
-		}
-
-		compareWith, err := dateparse.ParseAny(value)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverDate(receiverInterface)
-
-		if err != nil || !(receiver.Equal(compareWith) || receiver.After(compareWith)) {
-			return false
+			return false, err
 		}
+		return compare(receiver, compareWith), nil
 	}
-	return true
 }
 
 func getReceiverDate(receiverInterface interface{}) (time.Time, error) {
@@ -422,111 +354,18 @@ func getReceiverDate(receiverInterface interface{}) (time.Time, error) {
 	}
 }
 
-func (ce *ConditionEvaluator) numericEquals(params model.ConditionParams) bool {
-	for key, value := range params {
+func compareNumbers(compare func(receiver float64, value float64) bool) func(interface{}, string) (bool, error) {
+	return func(receiverInterface interface{}, value string) (bool, error) {
 		target, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			return false
+			return false, err
 		}
-
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverNum(receiverInterface)
-
-		if err != nil || !(receiver == target) {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) numericLessThanEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		target, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return false
-		}
-
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
 		receiver, err := getReceiverNum(receiverInterface)
-
-		if err != nil || !(receiver >= target) {
-			return false
-		}
-	}
-	return true
-}
-
-func (ce *ConditionEvaluator) numericGreaterThanEquals(params model.ConditionParams) bool {
-	for key, value := range params {
-		target, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			return false
-		}
-
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverNum(receiverInterface)
-
-		if err != nil || !(receiver >= target) {
-			return false
+			return false, err
 		}
+		return compare(receiver, target), nil
 	}
-	return true
-
-}
-
-func (ce *ConditionEvaluator) numericLessThan(params model.ConditionParams) bool {
-	for key, value := range params {
-		target, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return false
-		}
-
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverNum(receiverInterface)
-
-		if err != nil || !(receiver < target) {
-			return false
-		}
-	}
-	return true
-
-}
-
-func (ce *ConditionEvaluator) numericGreaterThan(params model.ConditionParams) bool {
-	for key, value := range params {
-		target, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return false
-		}
-
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, err := getReceiverNum(receiverInterface)
-
-		if err != nil || !(receiver > target) {
-			return false
-		}
-	}
-	return true
 }
 
 func getReceiverNum(receiverInterface interface{}) (float64, error) {
@@ -548,91 +387,55 @@ func getReceiverNum(receiverInterface interface{}) (float64, error) {
 	}
 }
 
-func (ce *ConditionEvaluator) bool_(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		r, err := strconv.ParseBool(receiver)
-		if err != nil {
-			return false
-		}
-
-		v, err := strconv.ParseBool(value)
-		if err != nil {
-			return false
-		}
-
-		if r != v {
-			return false
-		}
+func boolEquals(receiverInterface interface{}, value string) (bool, error) {
+	r, err := getReceiverBool(receiverInterface)
+	if err != nil {
+		return false, err
 	}
-	return true
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, err
+	}
+	return r == v, nil
 }
 
-func (ce *ConditionEvaluator) null_(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		shouldBeNull, err := strconv.ParseBool(value)
-		if err != nil {
-			return false
-		}
-
-		if !((receiverInterface == nil) && shouldBeNull) {
-			return false
-		}
+func getReceiverBool(receiverInterface interface{}) (bool, error) {
+	switch receiver := receiverInterface.(type) {
+	case string:
+		return strconv.ParseBool(receiver)
+	case bool:
+		return receiver, nil
+	default:
+		return false, errors.New("could not parse receiver as bool")
 	}
-	return true
 }
 
-func (ce *ConditionEvaluator) ipAddress(params model.ConditionParams) bool {
-	for key, value := range params {
-
+// null_ is met if every receiver is missing or present as its value true or false asks for.
+func (ce *ConditionEvaluator) null_(params model.ConditionParams) bool {
+	for key, values := range params {
 		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
+		if err != nil || len(values) != 1 {
 			return false
 		}
 
-		receiver, ok := receiverInterface.(string)
-		if !ok {
+		shouldBeNull, err := strconv.ParseBool(values[0])
+		if err != nil {
 			return false
 		}
 
-		if !ipOrCidrMatch(value, receiver) {
+		if (receiverInterface == nil) != shouldBeNull {
 			return false
 		}
 	}
 	return true
 }
 
-func (ce *ConditionEvaluator) notIpAddress(params model.ConditionParams) bool {
-	for key, value := range params {
-		receiverInterface, err := ce.resolveMatchingReceiver(key)
-		if err != nil {
-			return false
-		}
-
-		receiver, ok := receiverInterface.(string)
-		if !ok {
-			return false
-		}
-
-		if ipOrCidrMatch(value, receiver) {
-			return false
-		}
+func ipAddress(receiver interface{}, value string) (bool, error) {
+	r, ok := receiver.(string)
+	if !ok {
+		return false, errors.New("receiver is not a string")
 	}
-	return true
+	return ipOrCidrMatch(value, r), nil
 }
 
 func ipOrCidrMatch(ipOrCidrStr string, ipStr string) bool {
@@ -1 +1,88 @@
 package auth
+
+import (
+	"github.com/graphql-iam/agent/src/model"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConditionEvaluator_MultipleValues(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	request.Header.Set("X-Tenant", "acme")
+	claims := map[string]interface{}{
+		"groups": []interface{}{"dev", "ops"},
+		"level":  float64(3),
+	}
+
+	tests := []struct {
+		name      string
+		condition model.Condition
+		expected  bool
+	}{
+		{"any value matches", model.Condition{"StringEquals": {"header:X-Tenant": {"other", "acme"}}}, true},
+		{"no value matches", model.Condition{"StringEquals": {"header:X-Tenant": {"other", "third"}}}, false},
+		{"negated with a matching value", model.Condition{"StringNotEquals": {"header:X-Tenant": {"other", "acme"}}}, false},
+		{"negated without a matching value", model.Condition{"StringNotEquals": {"header:X-Tenant": {"other", "third"}}}, true},
+		{"list receiver without qualifier", model.Condition{"StringEquals": {"jwt:groups": {"dev"}}}, false},
+		{"for any value", model.Condition{"ForAnyValue:StringEquals": {"jwt:groups": {"admin", "ops"}}}, true},
+		{"for any value without match", model.Condition{"ForAnyValue:StringEquals": {"jwt:groups": {"admin"}}}, false},
+		{"for all values", model.Condition{"ForAllValues:StringEquals": {"jwt:groups": {"dev", "ops", "admin"}}}, true},
+		{"for all values with a value left", model.Condition{"ForAllValues:StringEquals": {"jwt:groups": {"dev"}}}, false},
+		{"for all values of a missing receiver", model.Condition{"ForAllValues:StringEquals": {"jwt:roles": {"dev"}}}, true},
+		{"for any value of a single receiver", model.Condition{"ForAnyValue:StringLike": {"header:X-Tenant": {"ac*"}}}, true},
+		{"if exists with a missing receiver", model.Condition{"StringEqualsIfExists": {"jwt:tenant": {"acme"}}}, true},
+		{"if exists with a present receiver", model.Condition{"StringEqualsIfExists": {"header:X-Tenant": {"other"}}}, false},
+		{"missing receiver without if exists", model.Condition{"StringEquals": {"jwt:tenant": {"acme"}}}, false},
+		{"numeric less than equals", model.Condition{"NumericLessThanEquals": {"jwt:level": {"3"}}}, true},
+		{"null false with a present receiver", model.Condition{"Null": {"jwt:level": {"false"}}}, true},
+		{"null true with a present receiver", model.Condition{"Null": {"jwt:level": {"true"}}}, false},
+		{"if exists with a missing header", model.Condition{"StringEqualsIfExists": {"header:X-Region": {"eu"}}}, true},
+		{"missing header without if exists", model.Condition{"StringEquals": {"header:X-Region": {""}}}, false},
+		{"for all values of a missing header", model.Condition{"ForAllValues:StringEquals": {"header:X-Region": {"eu"}}}, true},
+		{"null true with a missing header", model.Condition{"Null": {"header:X-Region": {"true"}}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ce := ConditionEvaluator{
+				condition: test.condition,
+				request:   *request,
+				claims:    claims,
+			}
+			if result := ce.Evaluate(); result != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestConditionEvaluator_NumericStrings(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+
+	tests := []struct {
+		name      string
+		condition model.Condition
+		expected  bool
+	}{
+		{"int argument", model.Condition{"StringEquals": {"arg:user.id": {"42"}}}, true},
+		{"negated int argument", model.Condition{"StringNotEquals": {"arg:user.id": {"42"}}}, false},
+		{"number variable", model.Condition{"StringEquals": {"var:id": {"42"}}}, true},
+		{"like a number", model.Condition{"StringLike": {"arg:user.id": {"4*"}}}, true},
+		{"fractional number", model.Condition{"StringEquals": {"arg:price": {"1.5"}}}, true},
+		{"boolean", model.Condition{"StringEquals": {"arg:active": {"true"}}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ce := ConditionEvaluator{
+				condition: test.condition,
+				request:   *request,
+				variables: map[string]interface{}{"id": float64(42)},
+				arguments: map[string]interface{}{"user.id": 42, "price": 1.5, "active": true},
+			}
+			if result := ce.Evaluate(); result != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/graphql-iam/agent/src/model"
+)
+
+// Decision is the outcome of evaluating a request against the roles of the caller.
+// Introspection is set if the operation selects __schema or __type. Conditional is set if a
+// statement with a condition was evaluated, the decision then depends on more than the operation.
+type Decision struct {
+	Allowed       bool               `json:"allowed"`
+	Action        string             `json:"action,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	Metrics       *QueryMetrics      `json:"metrics,omitempty"`
+	Introspection bool               `json:"introspection,omitempty"`
+	Conditional   bool               `json:"-"`
+	Resources     []ResourceDecision `json:"resources,omitempty"`
+}
+
+// ResourceDecision holds the statements of all evaluated roles and policies that
+// matched a single requested resource. TypeFields lists the Type.field names of the
+// resource and its parents, it is only set when the schema is known. ResponsePath is
+// only set if the resource was requested under an alias. Directives lists the directives
+// the resource was selected with, besides @skip and @include. BoundaryDenies and
+// OutsideBoundaries name the boundary statements denying and the boundaries not allowing it.
+type ResourceDecision struct {
+	Resource          string             `json:"resource"`
+	ResponsePath      string             `json:"responsePath,omitempty"`
+	TypeFields        []string           `json:"typeFields,omitempty"`
+	Directives        []string           `json:"directives,omitempty"`
+	Allowed           bool               `json:"allowed"`
+	Allows            []StatementRef     `json:"allows,omitempty"`
+	Denies            []StatementRef     `json:"denies,omitempty"`
+	ConditionFailures []ConditionFailure `json:"conditionFailures,omitempty"`
+	BoundaryDenies    []StatementRef     `json:"boundaryDenies,omitempty"`
+	OutsideBoundaries []string           `json:"outsideBoundaries,omitempty"`
+}
+
+// StatementRef identifies a statement within the role and policy it was evaluated in.
+type StatementRef struct {
+	Role        string         `json:"role"`
+	PolicyID    string         `json:"policyId,omitempty"`
+	PolicyName  string         `json:"policyName,omitempty"`
+	Sid         string         `json:"sid,omitempty"`
+	Effect      string         `json:"effect"`
+	Action      model.Patterns `json:"action,omitempty"`
+	NotAction   model.Patterns `json:"notAction,omitempty"`
+	Resource    model.Patterns `json:"resource,omitempty"`
+	NotResource model.Patterns `json:"notResource,omitempty"`
+}
+
+// ConditionFailure is recorded when a statement matched a resource but its condition was not met.
+type ConditionFailure struct {
+	Statement StatementRef `json:"statement"`
+	Operators []string     `json:"operators"`
+}
+
+func newStatementRef(role model.Role, policy model.Policy, statement model.Statement) StatementRef {
+	return StatementRef{
+		Role:        role.Name,
+		PolicyID:    policy.ID,
+		PolicyName:  policy.Name,
+		Sid:         statement.Sid,
+		Effect:      string(statement.Effect),
+		Action:      statement.Action,
+		NotAction:   statement.NotAction,
+		Resource:    statement.Resource,
+		NotResource: statement.NotResource,
+	}
+}
+
+func (s StatementRef) String() string {
+	return fmt.Sprintf("role %s, policy %s, statement %s (%s %s on %s)", s.Role, s.policy(), s.Sid, s.Effect, describePatterns(s.Action, s.NotAction), describePatterns(s.Resource, s.NotResource))
+}
+
+func describePatterns(patterns model.Patterns, notPatterns model.Patterns) string {
+	if len(notPatterns) > 0 {
+		return "all but " + notPatterns.String()
+	}
+	return patterns.String()
+}
+
+func (s StatementRef) policy() string {
+	if s.PolicyName != "" {
+		return s.PolicyName
+	}
+	return s.PolicyID
+}
+
+func policyName(policy model.Policy) string {
+	if policy.Name != "" {
+		return policy.Name
+	}
+	return policy.ID
+}
+
+// DeniedResources returns the requested resources that were not allowed.
+func (d Decision) DeniedResources() []string {
+	var denied []string
+	for _, resource := range d.Resources {
+		if !resource.Allowed {
+			denied = append(denied, resource.Resource)
+		}
+	}
+	return denied
+}
+
+// Reasons describes why the resources of a denied decision were not allowed.
+func (d Decision) Reasons() []string {
+	if d.Error != "" {
+		return []string{d.Error}
+	}
+
+	var reasons []string
+	for _, resource := range d.Resources {
+		if resource.Allowed {
+			continue
+		}
+		name := resource.name()
+		var resourceReasons []string
+		for _, deny := range resource.Denies {
+			resourceReasons = append(resourceReasons, fmt.Sprintf("%s %s was explicitly denied by %s", d.Action, name, deny))
+		}
+		for _, failure := range resource.ConditionFailures {
+			if failure.Statement.Effect == string(model.Allow) {
+				resourceReasons = append(resourceReasons, fmt.Sprintf("%s %s did not meet conditions %v of %s", d.Action, name, failure.Operators, failure.Statement))
+			}
+		}
+		for _, deny := range resource.BoundaryDenies {
+			resourceReasons = append(resourceReasons, fmt.Sprintf("%s %s was denied by the boundary %s", d.Action, name, deny))
+		}
+		for _, boundary := range resource.OutsideBoundaries {
+			resourceReasons = append(resourceReasons, fmt.Sprintf("%s %s is outside the boundary %s", d.Action, name, boundary))
+		}
+		if len(resourceReasons) == 0 {
+			resourceReasons = append(resourceReasons, fmt.Sprintf("%s %s is not allowed by any role", d.Action, name))
+		}
+		reasons = append(reasons, resourceReasons...)
+	}
+	return reasons
+}
+
+// name returns the resource together with the aliased response path it was requested as.
+func (r ResourceDecision) name() string {
+	if r.ResponsePath == "" {
+		return r.Resource
+	}
+	return fmt.Sprintf("%s (as %s)", r.Resource, r.ResponsePath)
+}
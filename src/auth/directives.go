@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+	"slices"
+)
+
+// executed reports whether a selection with the directives would be executed. As in the
+// GraphQL spec a selection is skipped if @skip has a true condition or @include a false one.
+// Conditions that can't be resolved keep the selection so it is still authorized. Skipping every
+// selection of a field doesn't skip the field, which the extractor then keeps as a resource.
+func executed(directives []*ast.Directive, variables map[string]interface{}) bool {
+	for _, directive := range directives {
+		condition, ok := directiveCondition(directive, variables)
+		if !ok {
+			continue
+		}
+		switch directive.Name.Value {
+		case "skip":
+			if condition {
+				return false
+			}
+		case "include":
+			if !condition {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func directiveCondition(directive *ast.Directive, variables map[string]interface{}) (bool, bool) {
+	for _, argument := range directive.Arguments {
+		if argument.Name.Value == "if" {
+			condition, ok := valueFromAST(argument.Value, variables).(bool)
+			return condition, ok
+		}
+	}
+	return false, false
+}
+
+// withDirectives returns the names of the directives added to the inherited ones,
+// leaving out @skip and @include, which only decide whether a selection is executed.
+func withDirectives(inherited []string, directives []*ast.Directive) []string {
+	result := inherited
+	for _, directive := range directives {
+		name := directive.Name.Value
+		if name == "skip" || name == "include" || slices.Contains(result, name) {
+			continue
+		}
+		result = append(append([]string{}, result...), name)
+	}
+	return result
+}
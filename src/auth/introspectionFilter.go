@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/graphql-iam/agent/src/model"
+	"strings"
+)
+
+type introspectionFilter struct {
+	pe        *PolicyEvaluator
+	roles     []model.Role
+	rootTypes map[string]string
+	visible   map[string]bool
+}
+
+// FilterIntrospection removes the fields none of the roles allow from the introspection results
+// in the response. Fields are evaluated as their Type.field resource, fields of the mutation and
+// subscription root with the mutation and subscription action. Types left without fields are
+// removed together with every field returning them.
+func (pe *PolicyEvaluator) FilterIntrospection(roles []model.Role, decision Decision, body []byte) ([]byte, error) {
+	var response map[string]json.RawMessage
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if len(response["data"]) == 0 || json.Unmarshal(response["data"], &data) != nil || data == nil {
+		return body, nil
+	}
+
+	filter := introspectionFilter{
+		pe:        pe,
+		roles:     roles,
+		rootTypes: pe.rootTypeActions(),
+		visible:   make(map[string]bool),
+	}
+
+	for _, resource := range decision.Resources {
+		if !IsIntrospectionResource(resource.Resource) {
+			continue
+		}
+		key := resource.Resource
+		if resource.ResponsePath != "" {
+			key = resource.ResponsePath
+		}
+		result, ok := data[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if resource.Resource == "__schema" {
+			filter.filterSchema(result)
+		} else {
+			filter.filterFields(result)
+		}
+	}
+
+	response["data"], err = json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+// rootTypeActions maps the root types to the action their fields are evaluated with.
+func (pe *PolicyEvaluator) rootTypeActions() map[string]string {
+	rootTypes := map[string]string{"Mutation": "mutation", "Subscription": "subscription"}
+	if pe.Schema != nil {
+		rootTypes = map[string]string{}
+		if pe.Schema.MutationType() != nil {
+			rootTypes[pe.Schema.MutationType().Name()] = "mutation"
+		}
+		if pe.Schema.SubscriptionType() != nil {
+			rootTypes[pe.Schema.SubscriptionType().Name()] = "subscription"
+		}
+	}
+	return rootTypes
+}
+
+func (f *introspectionFilter) isVisible(typeName string, fieldName string) bool {
+	typeField := typeName + "." + fieldName
+	if visible, ok := f.visible[typeField]; ok {
+		return visible
+	}
+
+	action, ok := f.rootTypes[typeName]
+	if !ok {
+		action = "query"
+	}
+	op := operation{
+		action:    action,
+		resources: []resource{{path: typeField, typeFields: []string{typeField}}},
+	}
+	decision := Decision{Resources: make([]ResourceDecision, 1)}
+	f.pe.evaluate(f.roles, op, &decision)
+
+	// the legacy evaluation allows everything to roles without statements for the action
+	visible := decision.Allowed && len(decision.Resources[0].Allows) > 0
+	f.visible[typeField] = visible
+	return visible
+}
+
+// filterFields removes the invisible fields of a single __Type result.
+func (f *introspectionFilter) filterFields(t map[string]interface{}) {
+	name, _ := t["name"].(string)
+	fields, ok := t["fields"].([]interface{})
+	if !ok || name == "" || strings.HasPrefix(name, "__") {
+		return
+	}
+
+	var visible []interface{}
+	for _, field := range fields {
+		fieldMap, _ := field.(map[string]interface{})
+		fieldName, _ := fieldMap["name"].(string)
+		if f.isVisible(name, fieldName) {
+			visible = append(visible, field)
+		}
+	}
+	t["fields"] = orEmpty(visible)
+}
+
+func (f *introspectionFilter) filterSchema(schema map[string]interface{}) {
+	types, ok := schema["types"].([]interface{})
+	if !ok {
+		return
+	}
+
+	roots := make(map[string]bool)
+	for _, root := range []string{"queryType", "mutationType", "subscriptionType"} {
+		if ref, ok := schema[root].(map[string]interface{}); ok {
+			name, _ := ref["name"].(string)
+			roots[name] = true
+		}
+	}
+
+	for _, t := range types {
+		if typeMap, ok := t.(map[string]interface{}); ok {
+			f.filterFields(typeMap)
+		}
+	}
+
+	// hiding a type can leave fields returning it and types with only such fields, repeat until stable
+	hidden := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, t := range types {
+			typeMap, _ := t.(map[string]interface{})
+			name, _ := typeMap["name"].(string)
+			if hidden[name] || strings.HasPrefix(name, "__") {
+				continue
+			}
+			if typeMap["kind"] == "UNION" {
+				typeMap["possibleTypes"] = visibleRefs(typeMap["possibleTypes"], hidden)
+				if len(typeMap["possibleTypes"].([]interface{})) == 0 {
+					hidden[name] = true
+					changed = true
+				}
+				continue
+			}
+			fields, ok := typeMap["fields"].([]interface{})
+			if !ok {
+				continue
+			}
+
+			var kept []interface{}
+			for _, field := range fields {
+				fieldMap, _ := field.(map[string]interface{})
+				if !hidden[namedType(fieldMap["type"])] {
+					kept = append(kept, field)
+				}
+			}
+			typeMap["fields"] = orEmpty(kept)
+
+			if len(kept) == 0 && !roots[name] {
+				hidden[name] = true
+				changed = true
+			}
+		}
+	}
+
+	var kept []interface{}
+	for _, t := range types {
+		typeMap, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := typeMap["name"].(string)
+		if hidden[name] {
+			continue
+		}
+		for _, list := range []string{"interfaces", "possibleTypes"} {
+			if _, ok := typeMap[list].([]interface{}); ok {
+				typeMap[list] = visibleRefs(typeMap[list], hidden)
+			}
+		}
+		kept = append(kept, t)
+	}
+	schema["types"] = orEmpty(kept)
+}
+
+func visibleRefs(refs interface{}, hidden map[string]bool) []interface{} {
+	list, _ := refs.([]interface{})
+	var visible []interface{}
+	for _, ref := range list {
+		if !hidden[namedType(ref)] {
+			visible = append(visible, ref)
+		}
+	}
+	return orEmpty(visible)
+}
+
+// namedType unwraps the list and non null wrappers of an introspected type reference.
+func namedType(ref interface{}) string {
+	for {
+		refMap, ok := ref.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if ofType, ok := refMap["ofType"].(map[string]interface{}); ok {
+			ref = ofType
+			continue
+		}
+		name, _ := refMap["name"].(string)
+		return name
+	}
+}
+
+// orEmpty keeps lists from being marshalled as null, which clients reject for introspection results.
+func orEmpty(list []interface{}) []interface{} {
+	if list == nil {
+		return []interface{}{}
+	}
+	return list
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-iam/agent/src/model"
+	"github.com/graphql-iam/agent/src/schema"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilterIntrospection(t *testing.T) {
+	testSchema, err := schema.FromSDL(`
+type User {
+  id: ID!
+  email: String
+}
+
+type Secret {
+  value: String
+}
+
+type Query {
+  me: User
+  secret: Secret
+}
+
+type Mutation {
+  deleteUser(id: ID!): Boolean
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     schema.IntrospectionQuery,
+		Claims:    map[string]interface{}{},
+		Schema:    testSchema,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowQueries",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyEmail",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"User.email"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyMutations",
+						Action:    model.Patterns{"mutation"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denySecrets",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"Secret.*"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	decision := pe.EvaluateRoles([]model.Role{testRole})
+	if !decision.Allowed || !decision.Introspection {
+		t.Fatalf("Expected the introspection query to be allowed, got %+v", decision)
+	}
+	if len(decision.Resources) != 1 || decision.Resources[0].Resource != "__schema" {
+		t.Fatalf("Expected __schema to be the only resource, got %+v", decision.Resources)
+	}
+
+	result := graphql.Do(graphql.Params{Schema: *testSchema, RequestString: schema.IntrospectionQuery})
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, err := pe.FilterIntrospection([]model.Role{testRole}, decision, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Data struct {
+			Schema struct {
+				Types []struct {
+					Name   string `json:"name"`
+					Fields []struct {
+						Name string `json:"name"`
+					} `json:"fields"`
+				} `json:"types"`
+			} `json:"__schema"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(filtered, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string][]string)
+	for _, typ := range response.Data.Schema.Types {
+		fields[typ.Name] = []string{}
+		for _, field := range typ.Fields {
+			fields[typ.Name] = append(fields[typ.Name], field.Name)
+		}
+	}
+
+	if _, ok := fields["Secret"]; ok {
+		t.Fatalf("Expected Secret to be hidden, got %v", fields["Secret"])
+	}
+	if len(fields["Query"]) != 1 || fields["Query"][0] != "me" {
+		t.Fatalf("Expected Query to only contain me, got %v", fields["Query"])
+	}
+	if len(fields["User"]) != 1 || fields["User"][0] != "id" {
+		t.Fatalf("Expected User to only contain id, got %v", fields["User"])
+	}
+	if len(fields["Mutation"]) != 0 {
+		t.Fatalf("Expected Mutation to have no fields, got %v", fields["Mutation"])
+	}
+	if _, ok := fields["String"]; !ok {
+		t.Fatal("Expected scalars to be kept")
+	}
+}
@@ -1,151 +1,311 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gobwas/glob"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-iam/agent/src/config"
 	"github.com/graphql-iam/agent/src/model"
 	"github.com/graphql-iam/agent/src/util"
+	"log"
 	"net/http"
+	"strings"
 )
 
 type PolicyEvaluator struct {
-	Request   http.Request
-	Variables map[string]interface{}
-	Query     string
-	Claims    map[string]interface{}
+	Request       http.Request
+	Variables     map[string]interface{}
+	Query         string
+	OperationName string
+	Claims        map[string]interface{}
+	Schema        *graphql.Schema
+	Limits        config.QueryLimits
+	Legacy        bool
+	Boundaries    []model.Policy
 }
 
-func (pe *PolicyEvaluator) EvaluateRoles(roles []model.Role) bool {
-	anyMatch := false
-	for _, role := range roles {
-		if pe.evaluateRole(role) {
-			anyMatch = true
-			break
-		}
+// EvaluateRoles gathers the statements of all policies of all roles. A resource is allowed if
+// no statement denies it and at least one allows it, the request if all of its resources are.
+// With Legacy set the request is allowed if any of the roles allows it on its own instead.
+// All roles are evaluated so that the decision lists every statement matching the resources.
+// Whatever the roles allow is limited by the boundaries afterwards.
+func (pe *PolicyEvaluator) EvaluateRoles(roles []model.Role) Decision {
+	op, err := parseRequest(pe.Query, pe.OperationName, pe.Schema, pe.Variables, pe.Limits)
+	if err != nil {
+		return Decision{Error: err.Error()}
 	}
-	return anyMatch
-}
 
-func (pe *PolicyEvaluator) evaluateRole(role model.Role) bool {
-	for _, policy := range role.Policies {
-		pass := pe.evaluatePolicy(policy)
-		if !pass {
-			return false
+	if exceeded := op.metrics.exceeded(pe.Limits); exceeded != "" {
+		return Decision{Action: op.action, Error: exceeded, Metrics: &op.metrics}
+	}
+	if len(op.resources) == 0 {
+		// without resources no statement is consulted, so nothing may be executed unchecked
+		return Decision{Action: op.action, Error: "operation selects no fields to authorize", Metrics: &op.metrics}
+	}
+
+	decision := Decision{
+		Action:    op.action,
+		Metrics:   &op.metrics,
+		Resources: make([]ResourceDecision, len(op.resources)),
+	}
+	for i, resource := range op.resources {
+		decision.Resources[i].Resource = resource.path
+		decision.Resources[i].TypeFields = resource.typeFields
+		decision.Resources[i].Directives = resource.directives
+		if resource.responsePath != resource.path {
+			decision.Resources[i].ResponsePath = resource.responsePath
 		}
+		decision.Introspection = decision.Introspection || IsIntrospectionResource(resource.path)
 	}
-	return true
+
+	pe.evaluate(roles, op, &decision)
+	return decision
 }
 
-func (pe *PolicyEvaluator) evaluatePolicy(policy model.Policy) bool {
-	actionResourceMap, err := parseRequest(pe.Query)
-	if err != nil {
-		return false
+func (pe *PolicyEvaluator) evaluate(roles []model.Role, op operation, decision *Decision) {
+	defer pe.applyBoundaries(op, decision)
+
+	if pe.Legacy {
+		for _, role := range roles {
+			if pe.evaluateRole(role, op, decision) {
+				decision.Allowed = true
+			}
+		}
+		return
 	}
 
-	for action, resources := range actionResourceMap {
-		pass := pe.evaluateStatementsForAction(action, resources, policy.Statements)
-		if !pass {
-			return false
+	for _, role := range roles {
+		for _, policy := range role.Policies {
+			pe.evaluatePolicy(role, policy, op, decision)
 		}
 	}
-	return true
+	decision.Allowed = len(roles) > 0
+	for i := range decision.Resources {
+		resource := &decision.Resources[i]
+		resource.Allowed = len(resource.Denies) == 0 && len(resource.Allows) > 0
+		decision.Allowed = decision.Allowed && resource.Allowed
+	}
 }
 
-func (pe *PolicyEvaluator) evaluateStatementsForAction(action string, resources []string, statements []model.Statement) bool {
-	statements = pe.statementsForAction(action, statements)
-	return !pe.anyDenied(resources, statements) && pe.allAllowed(resources, statements)
-}
+// boundaryRole is the role name statement references of boundaries are recorded with.
+const boundaryRole = "boundary"
 
-func (pe *PolicyEvaluator) anyDenied(resources []string, statements []model.Statement) bool {
-	statements = pe.denyStatements(statements)
-	for _, statement := range statements {
-		match := false
+// applyBoundaries denies the resources any boundary policy does not allow. Like with the evaluation
+// of roles a boundary allows a resource if no statement of it denies and at least one allows it.
+func (pe *PolicyEvaluator) applyBoundaries(op operation, decision *Decision) {
+	role := model.Role{Name: boundaryRole}
+	for _, boundary := range pe.Boundaries {
+		boundaryDecision := Decision{Resources: make([]ResourceDecision, len(op.resources))}
+		pe.evaluatePolicy(role, boundary, op, &boundaryDecision)
+		decision.Conditional = decision.Conditional || boundaryDecision.Conditional
 
-		for _, resource := range resources {
-			g, err := glob.Compile(statement.Resource, '.')
-			if err != nil {
-				fmt.Printf("Resource %s is malformed\n", statement.Resource)
-			}
-			if g.Match(resource) {
-				match = true
-				break
+		for i := range decision.Resources {
+			resource := &decision.Resources[i]
+			matched := boundaryDecision.Resources[i]
+			if len(matched.Denies) > 0 {
+				resource.BoundaryDenies = append(resource.BoundaryDenies, matched.Denies...)
+			} else if len(matched.Allows) == 0 {
+				resource.OutsideBoundaries = append(resource.OutsideBoundaries, policyName(boundary))
+			} else {
+				continue
 			}
+			resource.Allowed = false
+			decision.Allowed = false
 		}
+	}
+}
 
-		if statement.Condition != nil {
-			evaluator := ConditionEvaluator{
-				condition: statement.Condition,
-				request:   pe.Request,
-				variables: pe.Variables,
-				query:     pe.Query,
-				claims:    pe.Claims,
-			}
+// evaluateRole is the legacy evaluation of a role, which allows a resource if all of its policies do.
+func (pe *PolicyEvaluator) evaluateRole(role model.Role, op operation, decision *Decision) bool {
+	allowed := make([]bool, len(op.resources))
+	for i := range allowed {
+		allowed[i] = true
+	}
 
-			conditionMet := evaluator.Evaluate()
-			match = match && conditionMet
+	for _, policy := range role.Policies {
+		policyAllowed := pe.evaluatePolicy(role, policy, op, decision)
+		for i := range allowed {
+			allowed[i] = allowed[i] && policyAllowed[i]
 		}
+	}
 
-		if match {
-			fmt.Printf("Request was explicitly denied by statement %s\n", statement)
-			return true
+	pass := true
+	for i := range allowed {
+		if allowed[i] {
+			decision.Resources[i].Allowed = true
 		}
+		pass = pass && allowed[i]
 	}
-	return false
+	return pass
 }
 
-func (pe *PolicyEvaluator) allAllowed(resources []string, statements []model.Statement) bool {
-	statements = pe.allowStatements(statements)
+// evaluatePolicy records the statements matching the resources of the operation and returns for
+// every resource whether the policy allows it in the legacy evaluation, which is the case if
+// no deny statement matches it and every allow statement does.
+func (pe *PolicyEvaluator) evaluatePolicy(role model.Role, policy model.Policy, op operation, decision *Decision) []bool {
+	allowed := make([]bool, len(op.resources))
+	for i := range allowed {
+		allowed[i] = true
+	}
+
+	statements := pe.statementsForAction(op.action, policy.Statements)
 	for _, statement := range statements {
-		match := true
+		ref := newStatementRef(role, policy, statement)
+		decision.Conditional = decision.Conditional || statement.Condition != nil || statementHasPolicyVariables(statement)
+
+		resources, err := pe.compileResources(statement, op.metrics)
+		if err != nil {
+			log.Printf("Resource of statement %s can't be used: %v\n", statement.Sid, err)
+		}
 
-		for _, resource := range resources {
-			g, err := glob.Compile(statement.Resource, '.')
-			if err != nil {
-				fmt.Printf("Resource %s is malformed\n", statement.Resource)
+		for i, resource := range op.resources {
+			// a deny statement whose resources can't be resolved denies every resource, failing closed
+			match := statement.Effect == model.Deny
+			if err == nil {
+				match = resources.match(func(g glob.Glob) bool {
+					return matchResource(g, resource)
+				})
 			}
+			resourceDecision := &decision.Resources[i]
 
-			match = match && g.Match(resource)
+			// conditions are evaluated per resource since arg: receivers depend on the resource
+			if match {
+				if failedOperators := pe.failedConditionOperators(statement, resource, op.metrics); len(failedOperators) > 0 {
+					resourceDecision.ConditionFailures = append(resourceDecision.ConditionFailures, ConditionFailure{
+						Statement: ref,
+						Operators: failedOperators,
+					})
+					match = false
+				}
+			}
+
+			switch statement.Effect {
+			case model.Deny:
+				if match {
+					resourceDecision.Denies = append(resourceDecision.Denies, ref)
+					allowed[i] = false
+				}
+			case model.Allow:
+				if match {
+					resourceDecision.Allows = append(resourceDecision.Allows, ref)
+				} else {
+					allowed[i] = false
+				}
+			}
 		}
+	}
+	return allowed
+}
 
-		if statement.Condition != nil {
-			evaluator := ConditionEvaluator{
-				condition: statement.Condition,
-				request:   pe.Request,
-				variables: pe.Variables,
-				query:     pe.Query,
+// matchResource matches the path and the Type.field names of the resource, alone or followed
+// by @ and the name of one of its directives.
+func matchResource(g glob.Glob, resource resource) bool {
+	for _, name := range append([]string{resource.path}, resource.typeFields...) {
+		if g.Match(name) {
+			return true
+		}
+		for _, directive := range resource.directives {
+			if g.Match(name + "@" + directive) {
+				return true
 			}
+		}
+	}
+	return false
+}
 
-			conditionMet := evaluator.Evaluate()
+// compileResources compiles the resource patterns of the statement with their policy variables filled.
+func (pe *PolicyEvaluator) compileResources(statement model.Statement, metrics QueryMetrics) (compiledPatterns, error) {
+	evaluator := ConditionEvaluator{
+		request:   pe.Request,
+		variables: pe.Variables,
+		query:     pe.Query,
+		claims:    pe.Claims,
+		metrics:   metrics,
+	}
+	resources, err := evaluator.substituteAll(statement.Resource, escapeResource)
+	if err != nil {
+		return compiledPatterns{}, err
+	}
+	notResources, err := evaluator.substituteAll(statement.NotResource, escapeResource)
+	if err != nil {
+		return compiledPatterns{}, err
+	}
+	return compilePatterns(resources, notResources, '.')
+}
 
-			match = match && conditionMet
-		}
+func (pe *PolicyEvaluator) failedConditionOperators(statement model.Statement, resource resource, metrics QueryMetrics) []string {
+	if statement.Condition == nil {
+		return nil
+	}
 
-		if !match {
-			return false
+	evaluator := ConditionEvaluator{
+		condition: statement.Condition,
+		request:   pe.Request,
+		variables: pe.Variables,
+		query:     pe.Query,
+		claims:    pe.Claims,
+		arguments: resource.arguments,
+		metrics:   metrics,
+	}
+	// the condition of a deny statement counts as met if its policy variables can't be resolved
+	if statement.Effect == model.Deny {
+		if unresolved := evaluator.unresolvedOperators(); len(unresolved) > 0 {
+			log.Printf("Condition of statement %s can't be resolved: %s\n", statement.Sid, strings.Join(unresolved, ", "))
+			return nil
 		}
 	}
-	return true
+	return evaluator.failedOperators()
 }
 
 func (pe *PolicyEvaluator) statementsForAction(action string, statements []model.Statement) []model.Statement {
 	return util.FilterArray(statements, func(statement model.Statement) bool {
-		g, err := glob.Compile(statement.Action)
+		actions, err := compilePatterns(statement.Action, statement.NotAction)
 		if err != nil {
-			fmt.Printf("Action %s is malformed\n", statement.Action)
-			return false
+			// like with resources a malformed deny statement fails closed and applies to every action
+			log.Printf("Action of statement %s is malformed: %v\n", statement.Sid, err)
+			return statement.Effect == model.Deny
 		}
-		return g.Match(action)
+		return actions.match(func(g glob.Glob) bool {
+			return g.Match(action)
+		})
 	})
 }
 
-func (pe *PolicyEvaluator) denyStatements(allStatements []model.Statement) []model.Statement {
-	return util.FilterArray(allStatements, func(statement model.Statement) bool {
-		return statement.Effect == model.Deny
-	})
+// compiledPatterns are the patterns of a statement element, negated for notAction and notResource.
+type compiledPatterns struct {
+	globs   []glob.Glob
+	negated bool
 }
 
-func (pe *PolicyEvaluator) allowStatements(allStatements []model.Statement) []model.Statement {
-	return util.FilterArray(allStatements, func(statement model.Statement) bool {
-		return statement.Effect == model.Allow
-	})
+// compilePatterns compiles either the patterns or the negated patterns, a statement must not set both.
+func compilePatterns(patterns model.Patterns, notPatterns model.Patterns, separators ...rune) (compiledPatterns, error) {
+	if len(patterns) > 0 && len(notPatterns) > 0 {
+		return compiledPatterns{}, errors.New("patterns and negated patterns are both set")
+	}
+	compiled := compiledPatterns{negated: len(notPatterns) > 0}
+	if compiled.negated {
+		patterns = notPatterns
+	}
+	if len(patterns) == 0 {
+		return compiledPatterns{}, errors.New("no patterns are set")
+	}
+	for _, pattern := range patterns {
+		g, err := glob.Compile(pattern, separators...)
+		if err != nil {
+			return compiledPatterns{}, fmt.Errorf("pattern %s: %w", pattern, err)
+		}
+		compiled.globs = append(compiled.globs, g)
+	}
+	return compiled, nil
+}
+
+// match reports whether any pattern matches, or for negated patterns whether none does.
+func (c compiledPatterns) match(matches func(g glob.Glob) bool) bool {
+	for _, g := range c.globs {
+		if matches(g) {
+			return !c.negated
+		}
+	}
+	return c.negated
 }
@@ -1,9 +1,15 @@
 package auth
 
 import (
+	"fmt"
+	"github.com/graphql-iam/agent/src/config"
 	"github.com/graphql-iam/agent/src/model"
+	"github.com/graphql-iam/agent/src/schema"
+	"math"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRolesResolver_Resolve_AllowAll(t *testing.T) {
@@ -38,9 +44,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "*",
+						Action:    model.Patterns{"*"},
 						Effect:    "allow",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -50,7 +56,7 @@ query {
 
 	result := pe.EvaluateRoles([]model.Role{testRole})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatal("Expected Result to be true")
 	}
 }
@@ -87,9 +93,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "*",
+						Action:    model.Patterns{"*"},
 						Effect:    "deny",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -99,7 +105,7 @@ query {
 
 	result := pe.EvaluateRoles([]model.Role{testRole})
 
-	if result {
+	if result.Allowed {
 		t.Fatal("Expected Result to be false")
 	}
 }
@@ -154,9 +160,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "query",
+						Action:    model.Patterns{"query"},
 						Effect:    "allow",
-						Resource:  "testData**",
+						Resource:  model.Patterns{"testData**"},
 						Condition: nil,
 					},
 				},
@@ -168,9 +174,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "denyTitle",
-						Action:    "query",
+						Action:    model.Patterns{"query"},
 						Effect:    "deny",
-						Resource:  "testData.data.title",
+						Resource:  model.Patterns{"testData.data.title"},
 						Condition: nil,
 					},
 				},
@@ -180,13 +186,13 @@ query {
 
 	result := peDeny.EvaluateRoles([]model.Role{testRole})
 
-	if result {
+	if result.Allowed {
 		t.Fatalf("Expected Result to be false, query %s", queryDeny)
 	}
 
 	result = peAllow.EvaluateRoles([]model.Role{testRole})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatalf("Expected Result to be true, query %s", queryAllow)
 	}
 }
@@ -240,9 +246,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "query",
+						Action:    model.Patterns{"query"},
 						Effect:    "allow",
-						Resource:  "testData**",
+						Resource:  model.Patterns{"testData**"},
 						Condition: nil,
 					},
 				},
@@ -254,9 +260,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "denyMutations",
-						Action:    "mutation",
+						Action:    model.Patterns{"mutation"},
 						Effect:    "deny",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -266,13 +272,13 @@ query {
 
 	result := peDeny.EvaluateRoles([]model.Role{testRole})
 
-	if result {
+	if result.Allowed {
 		t.Fatalf("Expected Result to be false, query %s", queryDeny)
 	}
 
 	result = peAllow.EvaluateRoles([]model.Role{testRole})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatalf("Expected Result to be true, query %s", queryAllow)
 	}
 }
@@ -327,9 +333,9 @@ mutation {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "mutation",
+						Action:    model.Patterns{"mutation"},
 						Effect:    "allow",
-						Resource:  "testData**",
+						Resource:  model.Patterns{"testData**"},
 						Condition: nil,
 					},
 				},
@@ -341,9 +347,9 @@ mutation {
 				Statements: []model.Statement{
 					{
 						Sid:       "denyTitleMutation",
-						Action:    "mutation",
+						Action:    model.Patterns{"mutation"},
 						Effect:    "deny",
-						Resource:  "testData.data.title",
+						Resource:  model.Patterns{"testData.data.title"},
 						Condition: nil,
 					},
 				},
@@ -353,13 +359,13 @@ mutation {
 
 	result := peDeny.EvaluateRoles([]model.Role{testRole})
 
-	if result {
+	if result.Allowed {
 		t.Fatalf("Expected Result to be false, query %s", queryDeny)
 	}
 
 	result = peAllow.EvaluateRoles([]model.Role{testRole})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatalf("Expected Result to be true, query %s", queryAllow)
 	}
 }
@@ -407,9 +413,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "query",
+						Action:    model.Patterns{"query"},
 						Effect:    "allow",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -421,12 +427,12 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:      "denyTestHeader",
-						Action:   "query",
+						Action:   model.Patterns{"query"},
 						Effect:   "deny",
-						Resource: "**",
+						Resource: model.Patterns{"**"},
 						Condition: model.Condition{
 							"StringEquals": model.ConditionParams{
-								"header:X-Test": "test-val",
+								"header:X-Test": model.ConditionValues{"test-val"},
 							},
 						},
 					},
@@ -437,18 +443,18 @@ query {
 
 	result := peDeny.EvaluateRoles([]model.Role{testRole})
 
-	if result {
+	if result.Allowed {
 		t.Fatalf("Expected Result to be false, query %s", query)
 	}
 
 	result = peAllow.EvaluateRoles([]model.Role{testRole})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatalf("Expected Result to be true, query %s", query)
 	}
 }
 
-func TestRolesResolver_Resolve_MultipleRoles(t *testing.T) {
+func TestRolesResolver_Resolve_MultipleRoles_Legacy(t *testing.T) {
 	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
 	variables := map[string]interface{}{}
 	query := `
@@ -468,6 +474,7 @@ query {
 		Variables: variables,
 		Query:     query,
 		Claims:    claims,
+		Legacy:    true,
 	}
 
 	testRole1 := model.Role{
@@ -480,9 +487,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowAll",
-						Action:    "*",
+						Action:    model.Patterns{"*"},
 						Effect:    "allow",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -500,9 +507,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "denyAll",
-						Action:    "*",
+						Action:    model.Patterns{"*"},
 						Effect:    "deny",
-						Resource:  "**",
+						Resource:  model.Patterns{"**"},
 						Condition: nil,
 					},
 				},
@@ -520,9 +527,9 @@ query {
 				Statements: []model.Statement{
 					{
 						Sid:       "allowSomeOther",
-						Action:    "query",
+						Action:    model.Patterns{"query"},
 						Effect:    "allow",
-						Resource:  "some.other.path",
+						Resource:  model.Patterns{"some.other.path"},
 						Condition: nil,
 					},
 				},
@@ -533,21 +540,1623 @@ query {
 	// Two Allow
 	result := pe.EvaluateRoles([]model.Role{testRole1, testRole1})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatal("Expected Result to be true, two roles with allow")
 	}
 
 	// One Allow, one deny
 	result = pe.EvaluateRoles([]model.Role{testRole1, testRole2})
 
-	if !result {
+	if !result.Allowed {
 		t.Fatal("Expected Result to be true, one role with allow and one with deny")
 	}
 
 	// two deny
 	result = pe.EvaluateRoles([]model.Role{testRole2, testRole3})
 
-	if result {
+	if result.Allowed {
 		t.Fatal("Expected Result to be false, two roles with deny")
 	}
 }
+
+func TestRolesResolver_Resolve_DenyInFragment(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  testData {
+	...DataFields
+  }
+}
+
+fragment DataFields on TestData {
+  data {
+    ... on Data {
+      name
+    }
+    ...TitleField
+  }
+}
+
+fragment TitleField on Data {
+  title
+}
+`
+	queryCycle := `
+query {
+  testData {
+	...A
+  }
+}
+
+fragment A on TestData {
+  data {
+    ...B
+  }
+}
+
+fragment B on Data {
+  name
+  ...A
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	peCycle := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     queryCycle,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyTitle",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"testData.data.title"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatalf("Expected Result to be false, query %s", query)
+	}
+
+	result = peCycle.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatalf("Expected Result to be false, query %s", queryCycle)
+	}
+}
+
+func TestRolesResolver_Resolve_OperationName(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query Allowed {
+  testData {
+	data {
+      name
+	}
+  }
+}
+
+query Denied {
+  testData {
+	data {
+      title
+	}
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	peAllow := PolicyEvaluator{
+		Request:       *request,
+		Variables:     variables,
+		Query:         query,
+		OperationName: "Allowed",
+		Claims:        claims,
+	}
+
+	peDeny := PolicyEvaluator{
+		Request:       *request,
+		Variables:     variables,
+		Query:         query,
+		OperationName: "Denied",
+		Claims:        claims,
+	}
+
+	peNoName := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	peUnknownName := PolicyEvaluator{
+		Request:       *request,
+		Variables:     variables,
+		Query:         query,
+		OperationName: "Unknown",
+		Claims:        claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyTitle",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"testData.data.title"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := peAllow.EvaluateRoles([]model.Role{testRole})
+
+	if !result.Allowed {
+		t.Fatal("Expected Result to be true, operation Allowed")
+	}
+
+	result = peDeny.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false, operation Denied")
+	}
+
+	result = peNoName.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false, multiple operations without operationName")
+	}
+
+	result = peUnknownName.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false, unknown operationName")
+	}
+}
+
+func TestRolesResolver_Resolve_WithJwtCondition(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  testData {
+	data {
+      name
+	}
+  }
+}
+`
+
+	peAllow := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    map[string]interface{}{"tenant": "acme", "sub": "user-1"},
+	}
+
+	peDenyTenant := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    map[string]interface{}{"tenant": "other", "sub": "user-1"},
+	}
+
+	peDenySub := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    map[string]interface{}{"tenant": "acme", "sub": "blocked"},
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowTenant",
+						Action:   model.Patterns{"query"},
+						Effect:   "allow",
+						Resource: model.Patterns{"**"},
+						Condition: model.Condition{
+							"StringEquals": model.ConditionParams{
+								"jwt:tenant": model.ConditionValues{"acme"},
+							},
+						},
+					},
+					{
+						Sid:      "denyBlockedSub",
+						Action:   model.Patterns{"query"},
+						Effect:   "deny",
+						Resource: model.Patterns{"**"},
+						Condition: model.Condition{
+							"StringEquals": model.ConditionParams{
+								"jwt:sub": model.ConditionValues{"blocked"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := peAllow.EvaluateRoles([]model.Role{testRole})
+
+	if !result.Allowed {
+		t.Fatal("Expected Result to be true, matching tenant claim")
+	}
+
+	result = peDenyTenant.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false, other tenant claim")
+	}
+
+	result = peDenySub.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false, blocked sub claim")
+	}
+}
+
+func TestRolesResolver_Resolve_DecisionReasons(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  testData {
+	data {
+      name
+	  title
+	}
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyTitle",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"testData.data.title"},
+						Condition: nil,
+					},
+					{
+						Sid:      "denyNameWithHeader",
+						Action:   model.Patterns{"query"},
+						Effect:   "deny",
+						Resource: model.Patterns{"testData.data.name"},
+						Condition: model.Condition{
+							"StringEquals": model.ConditionParams{
+								"header:X-Test": model.ConditionValues{"test-val"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if result.Action != "query" {
+		t.Fatalf("Expected action query, got %s", result.Action)
+	}
+	if len(result.Resources) != 2 {
+		t.Fatalf("Expected 2 evaluated resources, got %d", len(result.Resources))
+	}
+
+	name, title := result.Resources[0], result.Resources[1]
+	if !name.Allowed || len(name.Allows) != 1 || len(name.ConditionFailures) != 1 {
+		t.Fatalf("Expected name to be allowed with one condition failure, got %+v", name)
+	}
+	if name.ConditionFailures[0].Statement.Sid != "denyNameWithHeader" || name.ConditionFailures[0].Operators[0] != "StringEquals" {
+		t.Fatalf("Unexpected condition failure %+v", name.ConditionFailures[0])
+	}
+	if title.Allowed || len(title.Denies) != 1 || title.Denies[0].Sid != "denyTitle" || title.Denies[0].Role != "test" {
+		t.Fatalf("Expected title to be denied by denyTitle, got %+v", title)
+	}
+
+	denied := result.DeniedResources()
+	if len(denied) != 1 || denied[0] != "testData.data.title" {
+		t.Fatalf("Expected only testData.data.title to be denied, got %v", denied)
+	}
+	if len(result.Reasons()) != 1 {
+		t.Fatalf("Expected one reason, got %v", result.Reasons())
+	}
+}
+
+func TestRolesResolver_Resolve_TypeFields(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  me {
+    name
+    email
+  }
+  posts {
+    title
+    author {
+      ...UserEmail
+    }
+  }
+  node(id: "1") {
+    ... on User {
+      email
+    }
+  }
+}
+
+fragment UserEmail on User {
+  email
+}
+`
+	claims := map[string]interface{}{}
+
+	testSchema, err := schema.FromSDL(`
+interface Node {
+  id: ID!
+}
+
+type User implements Node {
+  id: ID!
+  name: String
+  email: String
+}
+
+type Post {
+  title: String
+  author: User
+}
+
+type Query {
+  me: User
+  posts(first: Int): [Post!]!
+  node(id: ID!): Node
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+		Schema:    testSchema,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyEmail",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"User.email"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+
+	denied := result.DeniedResources()
+	expected := []string{"me.email", "posts.author.email", "node.email"}
+	if len(denied) != len(expected) {
+		t.Fatalf("Expected %v to be denied, got %v", expected, denied)
+	}
+	for i := range expected {
+		if denied[i] != expected[i] {
+			t.Fatalf("Expected %v to be denied, got %v", expected, denied)
+		}
+	}
+
+	author := result.Resources[3]
+	if len(author.TypeFields) != 3 || author.TypeFields[0] != "Query.posts" || author.TypeFields[2] != "User.email" {
+		t.Fatalf("Unexpected type fields %v", author.TypeFields)
+	}
+}
+
+func TestRolesResolver_Resolve_ArgumentCondition(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{"id": "43"}
+	query := `
+query User($id: ID!, $role: Role = ADMIN) {
+  mine: user(id: "42") {
+    name
+  }
+  other: user(id: $id) {
+    name
+  }
+  users(filter: {role: $role}) {
+    name
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:      "denyOtherUsers",
+						Action:   model.Patterns{"query"},
+						Effect:   "deny",
+						Resource: model.Patterns{"user.*"},
+						Condition: model.Condition{
+							"StringNotEquals": model.ConditionParams{
+								"arg:user.id": model.ConditionValues{"42"},
+							},
+						},
+					},
+					{
+						Sid:      "denyAdmins",
+						Action:   model.Patterns{"query"},
+						Effect:   "deny",
+						Resource: model.Patterns{"users.*"},
+						Condition: model.Condition{
+							"StringEquals": model.ConditionParams{
+								"arg:users.filter.role": model.ConditionValues{"ADMIN"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if len(result.Resources) != 3 {
+		t.Fatalf("Expected 3 evaluated resources, got %d", len(result.Resources))
+	}
+	if !result.Resources[0].Allowed {
+		t.Fatalf("Expected user with id 42 to be allowed, got %+v", result.Resources[0])
+	}
+	if result.Resources[1].Allowed || result.Resources[1].Denies[0].Sid != "denyOtherUsers" {
+		t.Fatalf("Expected user with id 43 to be denied, got %+v", result.Resources[1])
+	}
+	if result.Resources[2].Allowed || result.Resources[2].Denies[0].Sid != "denyAdmins" {
+		t.Fatalf("Expected users filtered by the default role to be denied, got %+v", result.Resources[2])
+	}
+}
+
+func TestRolesResolver_Resolve_QueryMetrics(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{"posts": float64(5)}
+	query := `
+query Users($posts: Int) {
+  users(first: 10) {
+    name
+    posts(first: $posts) {
+      title
+    }
+  }
+  me: user(id: 1) {
+    name
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowCheapQueries",
+						Action:   model.Patterns{"query"},
+						Effect:   "allow",
+						Resource: model.Patterns{"**"},
+						Condition: model.Condition{
+							"NumericLessThan": model.ConditionParams{
+								"query:cost":  model.ConditionValues{"100"},
+								"query:depth": model.ConditionValues{"4"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if !result.Allowed {
+		t.Fatalf("Expected Result to be true, got %v", result.Reasons())
+	}
+	expected := QueryMetrics{Depth: 3, Fields: 6, Aliases: 1, Cost: 73}
+	if result.Metrics == nil || result.Metrics.Depth != expected.Depth || result.Metrics.Fields != expected.Fields ||
+		result.Metrics.Aliases != expected.Aliases || result.Metrics.Cost != expected.Cost {
+		t.Fatalf("Expected metrics %+v, got %+v", expected, result.Metrics)
+	}
+
+	pe.Variables = map[string]interface{}{"posts": float64(50)}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Allowed {
+		t.Fatal("Expected Result to be false for an expensive query")
+	}
+
+	pe.Variables = variables
+	pe.Limits = config.QueryLimits{MaxDepth: 2}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Allowed || result.Error != "query depth of 3 exceeds the limit of 2" {
+		t.Fatalf("Expected the depth limit to reject the query, got %+v", result)
+	}
+
+	// nested list sizes saturate instead of overflowing into a small or negative cost
+	pe.Query = `
+query {
+  a(first: 2147483647) {
+    b(first: 2147483647) {
+      c(first: 2147483647) {
+        d(first: 2147483647) {
+          name
+        }
+      }
+    }
+  }
+}
+`
+	pe.Limits = config.QueryLimits{MaxCost: 1000}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Allowed || result.Metrics == nil || result.Metrics.Cost != math.MaxInt {
+		t.Fatalf("Expected the cost to saturate and exceed the limit, got %+v", result)
+	}
+}
+
+func TestRolesResolver_Resolve_Aliases(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  a: user(id: "1") {
+    name
+  }
+  b: user(id: "2") {
+    name
+    secret
+  }
+  c: user(id: "3") {
+    name
+  }
+  user(id: "4") {
+    name
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denySecret",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"user.secret"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	secret := result.Resources[2]
+	if secret.Resource != "user.secret" || secret.ResponsePath != "b.secret" {
+		t.Fatalf("Expected user.secret to be requested as b.secret, got %+v", secret)
+	}
+	if result.Resources[4].ResponsePath != "" {
+		t.Fatalf("Expected no response path without alias, got %+v", result.Resources[4])
+	}
+	if reasons := result.Reasons(); len(reasons) != 1 || !strings.Contains(reasons[0], "user.secret (as b.secret)") {
+		t.Fatalf("Expected the reason to name the alias, got %v", reasons)
+	}
+	if result.Metrics.Duplicates["user"] != 4 || result.Metrics.Duplicates["user.name"] != 4 || result.Metrics.MaxDuplicates != 4 {
+		t.Fatalf("Expected user to be selected under 4 keys, got %+v", result.Metrics)
+	}
+
+	pe.Limits = config.QueryLimits{MaxDuplicateFields: 3}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Error != "query duplicate field count of 4 exceeds the limit of 3" {
+		t.Fatalf("Expected the duplicate limit to reject the query, got %+v", result)
+	}
+}
+
+func TestRolesResolver_Resolve_Directives(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{"withSecret": false}
+	query := `
+query ($withSecret: Boolean!, $skipPosts: Boolean = true) {
+  user {
+    name
+    secret @include(if: $withSecret)
+    ...Contact @sensitive
+    posts @skip(if: $skipPosts) {
+      title
+    }
+  }
+}
+
+fragment Contact on User {
+  email
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denySecret",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"user.secret"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denySensitive",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"**@sensitive"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if len(result.Resources) != 2 {
+		t.Fatalf("Expected skipped fields to be left out, got %+v", result.Resources)
+	}
+	if result.Metrics.Fields != 3 {
+		t.Fatalf("Expected skipped fields not to be counted, got %+v", result.Metrics)
+	}
+	email := result.Resources[1]
+	if email.Resource != "user.email" || email.Allowed || email.Denies[0].Sid != "denySensitive" {
+		t.Fatalf("Expected user.email to be denied as sensitive, got %+v", email)
+	}
+
+	pe.Query = strings.Replace(query, "...Contact @sensitive", "", 1)
+	pe.Variables = map[string]interface{}{"withSecret": true, "skipPosts": false}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if denied := result.DeniedResources(); len(denied) != 1 || denied[0] != "user.secret" {
+		t.Fatalf("Expected only user.secret to be denied, got %v", denied)
+	}
+	if len(result.Resources) != 3 {
+		t.Fatalf("Expected included fields to be evaluated, got %+v", result.Resources)
+	}
+}
+
+func TestRolesResolver_Resolve_NotActionNotResource(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{}
+	query := `
+query {
+  public {
+    news
+  }
+  docs {
+    title
+  }
+  user {
+    name
+  }
+}
+`
+	claims := map[string]interface{}{}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:         "denyAllButPublic",
+						Action:      model.Patterns{"query"},
+						Effect:      "deny",
+						NotResource: model.Patterns{"public.**", "docs.**"},
+						Condition:   nil,
+					},
+					{
+						Sid:       "denyAllButQueries",
+						NotAction: model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if denied := result.DeniedResources(); len(denied) != 1 || denied[0] != "user.name" {
+		t.Fatalf("Expected only user.name to be denied, got %v", denied)
+	}
+	if reasons := result.Reasons(); len(reasons) != 1 || !strings.Contains(reasons[0], "deny query on all but [public.**, docs.**]") {
+		t.Fatalf("Expected the reason to describe the not resource, got %v", reasons)
+	}
+
+	pe.Query = `mutation { publish { id } }`
+	result = pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed || result.Resources[0].Denies[0].Sid != "denyAllButQueries" {
+		t.Fatalf("Expected mutations to be denied by the not action, got %+v", result)
+	}
+}
+
+func TestRolesResolver_Resolve_PolicyVariables(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	variables := map[string]interface{}{"userId": "u1"}
+	query := `
+query ($userId: ID!) {
+  tenants {
+    acme {
+      name
+    }
+    other {
+      name
+    }
+  }
+  user(id: $userId) {
+    name
+  }
+}
+`
+	claims := map[string]interface{}{"tenant_id": "acme", "sub": "u1"}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: variables,
+		Query:     query,
+		Claims:    claims,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowOwnTenant",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"tenants.${jwt:tenant_id}.**", "user.*"},
+						Condition: nil,
+					},
+					{
+						Sid:      "denyOtherUsers",
+						Action:   model.Patterns{"query"},
+						Effect:   "deny",
+						Resource: model.Patterns{"user.*"},
+						Condition: model.Condition{
+							"StringNotEquals": model.ConditionParams{"var:userId": model.ConditionValues{"${jwt:sub}"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{testRole})
+
+	if result.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+	if denied := result.DeniedResources(); len(denied) != 1 || denied[0] != "tenants.other.name" {
+		t.Fatalf("Expected only the other tenant to be denied, got %v", denied)
+	}
+
+	pe.Variables = map[string]interface{}{"userId": "u2"}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Resources[2].Allowed || result.Resources[2].Denies[0].Sid != "denyOtherUsers" {
+		t.Fatalf("Expected other users to be denied, got %+v", result.Resources[2])
+	}
+
+	for _, tenant := range []interface{}{"*", "{acme,other}", "acme.name", nil} {
+		pe.Claims = map[string]interface{}{"tenant_id": tenant, "sub": "u2"}
+		result = pe.EvaluateRoles([]model.Role{testRole})
+		if result.Resources[0].Allowed || result.Resources[1].Allowed {
+			t.Fatalf("Expected tenant %v not to match any tenant, got %+v", tenant, result.Resources)
+		}
+	}
+
+	// deny statements with variables that can't be resolved fail closed
+	pe.Variables = map[string]interface{}{"userId": "u1"}
+	pe.Claims = map[string]interface{}{"tenant_id": "acme"}
+	result = pe.EvaluateRoles([]model.Role{testRole})
+	if result.Resources[2].Allowed || len(result.Resources[2].Denies) != 1 || result.Resources[2].Denies[0].Sid != "denyOtherUsers" {
+		t.Fatalf("Expected the user to be denied without a sub claim, got %+v", result.Resources[2])
+	}
+
+	notResourceRole := model.Role{
+		Name: "notResource",
+		Policies: []model.Policy{
+			{
+				ID:      "2",
+				Name:    "notResource",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowAll",
+						Action:   model.Patterns{"query"},
+						Effect:   "allow",
+						Resource: model.Patterns{"**"},
+					},
+					{
+						Sid:         "denyOtherTenants",
+						Action:      model.Patterns{"query"},
+						Effect:      "deny",
+						NotResource: model.Patterns{"tenants.${jwt:tenant}.**", "user.*"},
+					},
+				},
+			},
+		},
+	}
+	pe.Claims = map[string]interface{}{"sub": "u1"}
+	result = pe.EvaluateRoles([]model.Role{notResourceRole})
+	if result.Allowed || result.Resources[0].Allowed || result.Resources[1].Allowed || result.Resources[2].Allowed {
+		t.Fatalf("Expected every resource to be denied without a tenant claim, got %+v", result.Resources)
+	}
+}
+
+func TestRolesResolver_Resolve_EvaluationMatrix(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	query := `
+query {
+  public {
+    news
+  }
+  account {
+    email
+  }
+}
+`
+
+	policy := func(id string, statements ...model.Statement) model.Policy {
+		return model.Policy{ID: id, Name: id, Version: "1", Statements: statements}
+	}
+	allow := func(resource string) model.Statement {
+		return model.Statement{Sid: "allow", Action: model.Patterns{"query"}, Effect: model.Allow, Resource: model.Patterns{resource}}
+	}
+	deny := func(resource string) model.Statement {
+		return model.Statement{Sid: "deny", Action: model.Patterns{"query"}, Effect: model.Deny, Resource: model.Patterns{resource}}
+	}
+	role := func(name string, policies ...model.Policy) model.Role {
+		return model.Role{Name: name, Policies: policies}
+	}
+
+	tests := []struct {
+		name     string
+		roles    []model.Role
+		legacy   bool
+		standard bool
+	}{
+		{
+			name:     "allow all in two roles",
+			roles:    []model.Role{role("a", policy("1", allow("**"))), role("b", policy("2", allow("**")))},
+			legacy:   true,
+			standard: true,
+		},
+		{
+			name:     "allow in one role, deny in another",
+			roles:    []model.Role{role("a", policy("1", allow("**"))), role("b", policy("2", deny("account.**")))},
+			legacy:   true,
+			standard: false,
+		},
+		{
+			name:     "allows split across the policies of a role",
+			roles:    []model.Role{role("a", policy("1", allow("public.**")), policy("2", allow("account.**")))},
+			legacy:   false,
+			standard: true,
+		},
+		{
+			name:     "allows split across roles",
+			roles:    []model.Role{role("a", policy("1", allow("public.**"))), role("b", policy("2", allow("account.**")))},
+			legacy:   false,
+			standard: true,
+		},
+		{
+			name:     "deny without any allow",
+			roles:    []model.Role{role("a", policy("1", deny("secret.**")))},
+			legacy:   true,
+			standard: false,
+		},
+		{
+			name:     "allow and deny in different policies of a role",
+			roles:    []model.Role{role("a", policy("1", allow("**")), policy("2", deny("account.email")))},
+			legacy:   false,
+			standard: false,
+		},
+		{
+			name:     "deny of a field that is not requested",
+			roles:    []model.Role{role("a", policy("1", allow("**"), deny("account.password")))},
+			legacy:   true,
+			standard: true,
+		},
+		{
+			name:     "allow of only some fields",
+			roles:    []model.Role{role("a", policy("1", allow("public.**")))},
+			legacy:   false,
+			standard: false,
+		},
+		{
+			name:     "no roles",
+			roles:    nil,
+			legacy:   false,
+			standard: false,
+		},
+	}
+
+	for _, test := range tests {
+		for _, legacy := range []bool{true, false} {
+			pe := PolicyEvaluator{
+				Request:   *request,
+				Variables: map[string]interface{}{},
+				Query:     query,
+				Claims:    map[string]interface{}{},
+				Legacy:    legacy,
+			}
+			expected := test.standard
+			if legacy {
+				expected = test.legacy
+			}
+
+			result := pe.EvaluateRoles(test.roles)
+
+			if result.Allowed != expected {
+				t.Errorf("%s (legacy %v): expected allowed to be %v, got %+v", test.name, legacy, expected, result)
+			}
+		}
+	}
+}
+
+func TestRolesResolver_Resolve_Boundaries(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	request.RemoteAddr = "203.0.113.7:4711"
+	query := `
+query {
+  user {
+    name
+    ssn
+  }
+}
+`
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     query,
+		Claims:    map[string]interface{}{},
+		Boundaries: []model.Policy{
+			{
+				ID:      "guardrails",
+				Name:    "guardrails",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:      "denySsnOutsideVpn",
+						Action:   model.Patterns{"*"},
+						Effect:   "deny",
+						Resource: model.Patterns{"*.ssn"},
+						Condition: model.Condition{
+							"NotIpAddress": model.ConditionParams{"request:remoteAddr": model.ConditionValues{"10.0.0.0/8"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testRole := model.Role{
+		Name: "admin",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "admin",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	for _, legacy := range []bool{true, false} {
+		pe.Legacy = legacy
+		result := pe.EvaluateRoles([]model.Role{testRole})
+
+		if result.Allowed {
+			t.Fatalf("Expected the boundary to deny the ssn outside the vpn (legacy %v)", legacy)
+		}
+		if denied := result.DeniedResources(); len(denied) != 1 || denied[0] != "user.ssn" {
+			t.Fatalf("Expected only user.ssn to be denied, got %v", denied)
+		}
+		if reasons := result.Reasons(); len(reasons) != 1 || !strings.Contains(reasons[0], "denied by the boundary role boundary, policy guardrails, statement denySsnOutsideVpn") {
+			t.Fatalf("Expected the reason to name the boundary, got %v", reasons)
+		}
+	}
+
+	pe.Request.RemoteAddr = "10.1.2.3:4711"
+	if result := pe.EvaluateRoles([]model.Role{testRole}); !result.Allowed {
+		t.Fatalf("Expected the ssn to be allowed inside the vpn, got %v", result.Reasons())
+	}
+
+	pe.Boundaries = append(pe.Boundaries, model.Policy{
+		ID:      "publicOnly",
+		Version: "1",
+		Statements: []model.Statement{
+			{
+				Sid:       "allowPublic",
+				Action:    model.Patterns{"query"},
+				Effect:    "allow",
+				Resource:  model.Patterns{"public.**"},
+				Condition: nil,
+			},
+		},
+	})
+	result := pe.EvaluateRoles([]model.Role{testRole})
+	if result.Allowed || result.Resources[0].OutsideBoundaries[0] != "publicOnly" {
+		t.Fatalf("Expected user.name to be outside the public only boundary, got %+v", result.Resources[0])
+	}
+}
+
+func TestRolesResolver_Resolve_FragmentCyclesBelowSkippedFields(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	queries := []string{
+		`query { __typename { ...A } } fragment A on Query { x ...A }`,
+		`query { __schema { ...A } } fragment A on __Schema { types { name } ...A }`,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	for _, query := range queries {
+		pe := PolicyEvaluator{
+			Request:   *request,
+			Variables: map[string]interface{}{},
+			Query:     query,
+			Claims:    map[string]interface{}{},
+		}
+
+		result := pe.EvaluateRoles([]model.Role{testRole})
+
+		if result.Allowed || result.Error != "cannot spread fragment A within itself" {
+			t.Fatalf("Expected the fragment cycle of %s to be rejected, got %+v", query, result)
+		}
+	}
+}
+
+func TestRolesResolver_Resolve_TypenameOnlySelections(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+
+	denyAllRole := model.Role{
+		Name: "denyAll",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "denyAll",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	for _, legacy := range []bool{false, true} {
+		pe := PolicyEvaluator{
+			Request:   *request,
+			Variables: map[string]interface{}{},
+			Query:     `mutation { deleteUser(id: 1) { __typename } }`,
+			Claims:    map[string]interface{}{},
+			Legacy:    legacy,
+		}
+
+		result := pe.EvaluateRoles([]model.Role{denyAllRole})
+
+		if result.Allowed || len(result.Resources) != 1 || result.Resources[0].Resource != "deleteUser" {
+			t.Fatalf("Expected deleteUser to be denied with legacy %v, got %+v", legacy, result)
+		}
+
+		pe.Query = `query { __typename }`
+		result = pe.EvaluateRoles([]model.Role{denyAllRole})
+		if result.Allowed || len(result.Resources) != 1 || result.Resources[0].Resource != "__typename" {
+			t.Fatalf("Expected __typename to be denied with legacy %v, got %+v", legacy, result)
+		}
+	}
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     `query { user { __typename } }`,
+		Claims:    map[string]interface{}{},
+	}
+	result := pe.EvaluateRoles([]model.Role{denyAllRole})
+	query, stripped, err := StripDenied(pe.Query, "", result)
+	if err != ErrNothingAllowed || len(stripped) != 1 || stripped[0].Resource != "user" {
+		t.Fatalf("Expected user to be stripped as a whole, got %q, %+v, %v", query, stripped, err)
+	}
+}
+
+func TestRolesResolver_Resolve_NoResources(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     `query { user @skip(if: true) { name } }`,
+		Claims:    map[string]interface{}{},
+	}
+
+	result := pe.EvaluateRoles([]model.Role{{Name: "empty"}})
+
+	if result.Allowed || result.Error != "operation selects no fields to authorize" {
+		t.Fatalf("Expected an operation without resources to be denied, got %+v", result)
+	}
+}
+
+func TestRolesResolver_Resolve_SkippedSelections(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	queries := []string{
+		`mutation { deleteUser(id: 1) { id @skip(if: true) } }`,
+		`mutation { deleteUser(id: 1) { id @include(if: false) } }`,
+		`mutation ($skip: Boolean!) { deleteUser(id: 1) { ...F @skip(if: $skip) } } fragment F on User { id }`,
+		`mutation { deleteUser(id: 1) { ... @skip(if: true) { id } } }`,
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"*"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyDeleteUser",
+						Action:    model.Patterns{"mutation"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"deleteUser", "deleteUser.**"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	for _, query := range queries {
+		pe := PolicyEvaluator{
+			Request:   *request,
+			Variables: map[string]interface{}{"skip": true},
+			Query:     query,
+			Claims:    map[string]interface{}{},
+		}
+
+		result := pe.EvaluateRoles([]model.Role{testRole})
+
+		if result.Allowed || len(result.Resources) != 1 || result.Resources[0].Resource != "deleteUser" {
+			t.Fatalf("Expected deleteUser of %s to be denied, got %+v", query, result)
+		}
+	}
+}
+
+func TestRolesResolver_Resolve_ExponentialFragments(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+
+	// every fragment spreads the next one twice, which doubles the fields with every level
+	var query strings.Builder
+	query.WriteString("query { user { ...F0 } }")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&query, " fragment F%d on User { a: name ...F%d b: name ...F%d }", i, i+1, i+1)
+	}
+	query.WriteString(" fragment F40 on User { name }")
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     query.String(),
+		Claims:    map[string]interface{}{},
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		limits config.QueryLimits
+		error  string
+	}{
+		{"without limits", query.String(), config.QueryLimits{}, errTooManySelections.Error()},
+		{"below introspection", strings.Replace(query.String(), "user", "__schema", 1), config.QueryLimits{}, errTooManySelections.Error()},
+		{"field limit", query.String(), config.QueryLimits{MaxFields: 100}, "query field count of 101 exceeds the limit of 100"},
+		{"cost limit", query.String(), config.QueryLimits{MaxCost: 50}, "query cost of "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pe := pe
+			pe.Query = test.query
+			pe.Limits = test.limits
+
+			done := make(chan Decision)
+			go func() {
+				done <- pe.EvaluateRoles([]model.Role{{Name: "empty"}})
+			}()
+
+			select {
+			case result := <-done:
+				if result.Allowed || !strings.HasPrefix(result.Error, test.error) {
+					t.Fatalf("Expected the query to be rejected with %q, got %+v", test.error, result)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected the expansion of the fragments to be aborted")
+			}
+		})
+	}
+}
+
+func TestRolesResolver_Resolve_InterfaceTypeFields(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	testSchema, err := schema.FromSDL(`
+interface Account {
+  email: String
+}
+
+type User implements Account {
+  email: String
+  name: String
+}
+
+type Query {
+  user: User
+  me: Account
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyEmail",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"User.email"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	for _, query := range []string{`{ user { email } }`, `{ me { email } }`, `{ me { ... on Account { email } } }`} {
+		pe := PolicyEvaluator{
+			Request:   *request,
+			Variables: map[string]interface{}{},
+			Query:     query,
+			Claims:    map[string]interface{}{},
+			Schema:    testSchema,
+		}
+
+		result := pe.EvaluateRoles([]model.Role{testRole})
+
+		if result.Allowed || len(result.Resources) != 1 || len(result.Resources[0].Denies) != 1 {
+			t.Fatalf("Expected the email of %s to be denied, got %+v", query, result.Resources)
+		}
+	}
+}
+
+func TestRolesResolver_Resolve_MalformedActions(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	malformed := []model.Statement{
+		{Sid: "both", Action: model.Patterns{"query"}, NotAction: model.Patterns{"mutation"}, Effect: "deny", Resource: model.Patterns{"**"}},
+		{Sid: "neither", Effect: "deny", Resource: model.Patterns{"**"}},
+		{Sid: "badGlob", Action: model.Patterns{"[query"}, Effect: "deny", Resource: model.Patterns{"**"}},
+	}
+
+	for _, legacy := range []bool{false, true} {
+		for _, statement := range malformed {
+			testRole := model.Role{
+				Name: "test",
+				Policies: []model.Policy{
+					{
+						ID:      "1",
+						Name:    "test",
+						Version: "1",
+						Statements: []model.Statement{
+							{
+								Sid:       "allowAll",
+								Action:    model.Patterns{"*"},
+								Effect:    "allow",
+								Resource:  model.Patterns{"**"},
+								Condition: nil,
+							},
+							statement,
+						},
+					},
+				},
+			}
+			pe := PolicyEvaluator{
+				Request:   *request,
+				Variables: map[string]interface{}{},
+				Query:     `query { user { name } }`,
+				Claims:    map[string]interface{}{},
+				Legacy:    legacy,
+			}
+
+			result := pe.EvaluateRoles([]model.Role{testRole})
+
+			if result.Allowed || len(result.Resources[0].Denies) != 1 || result.Resources[0].Denies[0].Sid != statement.Sid {
+				t.Fatalf("Expected the malformed statement %s to deny with legacy %v, got %+v", statement.Sid, legacy, result.Resources)
+			}
+		}
+	}
+}
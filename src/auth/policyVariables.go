@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gobwas/glob"
+	"github.com/graphql-iam/agent/src/model"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// policyVariablePattern matches placeholders like ${jwt:sub}, which take any receiver of a condition.
+var policyVariablePattern = regexp.MustCompile(`\$\{([^}]+)}`)
+
+func hasPolicyVariables(value string) bool {
+	return strings.Contains(value, "${")
+}
+
+// statementHasPolicyVariables reports whether the resources or condition values of the statement use policy variables.
+func statementHasPolicyVariables(statement model.Statement) bool {
+	for _, pattern := range append(append(model.Patterns{}, statement.Resource...), statement.NotResource...) {
+		if hasPolicyVariables(pattern) {
+			return true
+		}
+	}
+	for _, params := range statement.Condition {
+		for _, values := range params {
+			for _, value := range values {
+				if hasPolicyVariables(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// substitutePolicyVariables replaces the placeholders of value with the values of their receivers
+// passed through escape. It fails if a receiver can't be resolved to a string, number or bool.
+func (ce *ConditionEvaluator) substitutePolicyVariables(value string, escape func(string) (string, error)) (string, error) {
+	if !hasPolicyVariables(value) {
+		return value, nil
+	}
+
+	var substituteErr error
+	result := policyVariablePattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		receiver := policyVariablePattern.FindStringSubmatch(placeholder)[1]
+		resolved, err := ce.resolveMatchingReceiver(receiver)
+		if err == nil {
+			var text string
+			text, err = policyVariableText(resolved)
+			if err == nil {
+				text, err = escape(text)
+				if err == nil {
+					return text
+				}
+			}
+		}
+		if substituteErr == nil {
+			substituteErr = fmt.Errorf("policy variable %s: %w", receiver, err)
+		}
+		return ""
+	})
+	return result, substituteErr
+}
+
+func policyVariableText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", errors.New("value is missing")
+	}
+	return "", fmt.Errorf("value of type %T can't be used", value)
+}
+
+// escapeLiteral leaves values substituted into plain condition values as they are.
+func escapeLiteral(value string) (string, error) {
+	return value, nil
+}
+
+// escapeGlob quotes the glob meta characters of values substituted into patterns, including
+// commas which would separate alternatives within braces.
+func escapeGlob(value string) (string, error) {
+	return strings.ReplaceAll(glob.QuoteMeta(value), ",", `\,`), nil
+}
+
+// escapeResource additionally rejects values containing the separator of resources, so that a
+// value can only ever stand for a single field name.
+func escapeResource(value string) (string, error) {
+	if strings.Contains(value, ".") {
+		return "", errors.New("value must not contain a dot")
+	}
+	return escapeGlob(value)
+}
+
+// substituteAll replaces the placeholders of all values with escaped values.
+func (ce *ConditionEvaluator) substituteAll(values []string, escape func(string) (string, error)) ([]string, error) {
+	var result []string
+	for _, value := range values {
+		substituted, err := ce.substitutePolicyVariables(value, escape)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, substituted)
+	}
+	return result, nil
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-iam/agent/src/config"
+	"math"
+)
+
+// listSizeArguments are the arguments taken as the number of items a list field returns.
+var listSizeArguments = []string{"first", "last", "limit"}
+
+// QueryMetrics describe the size of an operation with fragments expanded. Cost counts every field
+// once per item its parents return, using the list size arguments of the parents.
+// Duplicates counts the response keys of every field path selected under more than one key,
+// MaxDuplicates is the highest of these counts.
+type QueryMetrics struct {
+	Depth         int            `json:"depth"`
+	Fields        int            `json:"fields"`
+	Aliases       int            `json:"aliases"`
+	Cost          int            `json:"cost"`
+	MaxDuplicates int            `json:"maxDuplicates"`
+	Duplicates    map[string]int `json:"duplicates,omitempty"`
+}
+
+// metricsCollector walks every selection, including those below fields the extractor doesn't descend
+// into, so it detects fragment cycles on its own. visiting holds the fragments on the current spread
+// chain, err the first cycle found. The walk stops as soon as the metrics exceed a limit or the
+// budget of selections is used up.
+type metricsCollector struct {
+	fragments    map[string]*ast.FragmentDefinition
+	variables    map[string]interface{}
+	limits       config.QueryLimits
+	budget       int
+	exceeded     bool
+	metrics      QueryMetrics
+	responseKeys map[string]map[string]bool
+	visiting     map[string]bool
+	err          error
+}
+
+// measureOperation leaves out selections skipped by @skip or @include and fails on fragment cycles.
+// If a limit is exceeded the metrics measured until then are returned, which exceed it as well.
+func measureOperation(opDef *ast.OperationDefinition, fragments map[string]*ast.FragmentDefinition, variables map[string]interface{}, limits config.QueryLimits) (QueryMetrics, error) {
+	mc := metricsCollector{
+		fragments:    fragments,
+		variables:    variables,
+		limits:       limits,
+		budget:       maxExpandedSelections,
+		responseKeys: make(map[string]map[string]bool),
+		visiting:     make(map[string]bool),
+	}
+	mc.metrics.Cost = mc.measure(opDef.SelectionSet.Selections, 1, "", "")
+	if mc.err != nil {
+		return QueryMetrics{}, mc.err
+	}
+
+	// selecting the same field under the same key again is merged by the server and not counted
+	for path, keys := range mc.responseKeys {
+		if len(keys) < 2 {
+			continue
+		}
+		if mc.metrics.Duplicates == nil {
+			mc.metrics.Duplicates = make(map[string]int)
+		}
+		mc.metrics.Duplicates[path] = len(keys)
+		mc.metrics.MaxDuplicates = max(mc.metrics.MaxDuplicates, len(keys))
+	}
+	return mc.metrics, nil
+}
+
+// measure returns the cost of the selections, depth is the depth of the fields selected.
+// prefix and responsePrefix are the field path and the response path of the parent.
+func (mc *metricsCollector) measure(selections []ast.Selection, depth int, prefix string, responsePrefix string) int {
+	cost := 0
+	for _, selection := range selections {
+		if mc.stopped(cost) {
+			return cost
+		}
+		mc.budget--
+		if mc.budget < 0 {
+			mc.err = errTooManySelections
+			return cost
+		}
+		switch sel := selection.(type) {
+		case *ast.Field:
+			if !executed(sel.Directives, mc.variables) {
+				continue
+			}
+			qualifiedName := prefix + sel.Name.Value
+			responsePath := responsePrefix + responseKey(sel)
+			if mc.responseKeys[qualifiedName] == nil {
+				mc.responseKeys[qualifiedName] = make(map[string]bool)
+			}
+			mc.responseKeys[qualifiedName][responsePath] = true
+
+			mc.metrics.Fields++
+			if sel.Alias != nil && sel.Alias.Value != "" {
+				mc.metrics.Aliases++
+			}
+			if depth > mc.metrics.Depth {
+				mc.metrics.Depth = depth
+			}
+			cost++
+			if sel.SelectionSet != nil {
+				cost = saturatingAdd(cost, saturatingMul(mc.listSize(sel), mc.measure(sel.SelectionSet.Selections, depth+1, qualifiedName+".", responsePath+".")))
+			}
+		case *ast.InlineFragment:
+			if !executed(sel.Directives, mc.variables) {
+				continue
+			}
+			cost = saturatingAdd(cost, mc.measure(sel.SelectionSet.Selections, depth, prefix, responsePrefix))
+		case *ast.FragmentSpread:
+			if !executed(sel.Directives, mc.variables) {
+				continue
+			}
+			name := sel.Name.Value
+			fragment, ok := mc.fragments[name]
+			if !ok {
+				continue
+			}
+			if mc.visiting[name] {
+				if mc.err == nil {
+					mc.err = fmt.Errorf("cannot spread fragment %s within itself", name)
+				}
+				continue
+			}
+			mc.visiting[name] = true
+			cost = saturatingAdd(cost, mc.measure(fragment.SelectionSet.Selections, depth, prefix, responsePrefix))
+			delete(mc.visiting, name)
+		}
+	}
+	return cost
+}
+
+// stopped reports whether the walk has to end since it failed or the metrics exceed a limit.
+// cost is the cost of the selections measured so far, which the cost of the operation is at least.
+func (mc *metricsCollector) stopped(cost int) bool {
+	if mc.err != nil || mc.exceeded {
+		return true
+	}
+	metrics := mc.metrics
+	metrics.Cost = cost
+	mc.exceeded = metrics.exceeded(mc.limits) != ""
+	return mc.exceeded
+}
+
+func (mc *metricsCollector) listSize(field *ast.Field) int {
+	for _, argument := range field.Arguments {
+		for _, name := range listSizeArguments {
+			if argument.Name.Value != name {
+				continue
+			}
+			switch size := valueFromAST(argument.Value, mc.variables).(type) {
+			case int:
+				return max(size, 1)
+			case float64:
+				if size >= math.MaxInt {
+					return math.MaxInt
+				}
+				return max(int(size), 1)
+			}
+		}
+	}
+	return 1
+}
+
+// saturatingAdd and saturatingMul cap costs at math.MaxInt instead of overflowing. Costs are never negative.
+func saturatingAdd(a int, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+func saturatingMul(a int, b int) int {
+	if a != 0 && b > math.MaxInt/a {
+		return math.MaxInt
+	}
+	return a * b
+}
+
+// exceeded returns a description of the first limit the metrics exceed, limits of 0 are ignored.
+func (m QueryMetrics) exceeded(limits config.QueryLimits) string {
+	checks := []struct {
+		name  string
+		value int
+		limit int
+	}{
+		{"depth", m.Depth, limits.MaxDepth},
+		{"field count", m.Fields, limits.MaxFields},
+		{"alias count", m.Aliases, limits.MaxAliases},
+		{"cost", m.Cost, limits.MaxCost},
+		{"duplicate field count", m.MaxDuplicates, limits.MaxDuplicateFields},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.value > check.limit {
+			return fmt.Sprintf("query %s of %d exceeds the limit of %d", check.name, check.value, check.limit)
+		}
+	}
+	return ""
+}
+
+func (m QueryMetrics) value(key string) (int, bool) {
+	switch key {
+	case "depth":
+		return m.Depth, true
+	case "fields":
+		return m.Fields, true
+	case "aliases":
+		return m.Aliases, true
+	case "cost":
+		return m.Cost, true
+	case "duplicates":
+		return m.MaxDuplicates, true
+	}
+	return 0, false
+}
@@ -2,15 +2,80 @@ package auth
 
 import (
 	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
 	"github.com/graphql-go/graphql/language/source"
+	"github.com/graphql-iam/agent/src/config"
 	"log"
+	"strconv"
 )
 
-func parseRequest(requestBody string) (map[string][]string, error) {
-	fieldMap := make(map[string][]string)
+type operation struct {
+	action    string
+	resources []resource
+	metrics   QueryMetrics
+}
+
+// resource is a requested leaf field. typeFields holds the Type.field names of the field and
+// its parents when the schema is known, a statement matching any of them matches the resource.
+// Fields selected on an interface are named after the interface and every implementing type.
+// arguments holds the argument values of the field and its parents keyed by field path and
+// argument name, e.g. user.id, with variables already replaced by their values.
+// responsePath is the path of response keys, which differs from path if aliases are used.
+// directives holds the names of the directives on the field, its parents and the fragments
+// it was selected in, a statement matching path@directive or Type.field@directive matches it.
+type resource struct {
+	path         string
+	responsePath string
+	typeFields   []string
+	arguments    map[string]interface{}
+	directives   []string
+}
+
+// parseRequest measures the operation before extracting its resources, so that operations exceeding
+// the limits are not expanded any further. Their operation carries the metrics but no resources.
+func parseRequest(requestBody string, operationName string, schema *graphql.Schema, variables map[string]interface{}, limits config.QueryLimits) (operation, error) {
+	queryAST, err := parseDocument(requestBody)
+	if err != nil {
+		return operation{}, err
+	}
 
+	opDef, err := selectOperation(queryAST, operationName)
+	if err != nil {
+		return operation{}, err
+	}
+
+	fragments := collectFragments(queryAST)
+	values := variableValues(opDef, variables)
+	metrics, err := measureOperation(opDef, fragments, values, limits)
+	if err != nil {
+		return operation{}, err
+	}
+	if metrics.exceeded(limits) != "" {
+		return operation{action: opDef.Operation, metrics: metrics}, nil
+	}
+
+	extractor := fieldExtractor{
+		schema:    schema,
+		fragments: fragments,
+		variables: values,
+		budget:    maxExpandedSelections,
+	}
+	fields, err := extractor.extract("", rootType(schema, opDef.Operation), fieldContext{}, opDef.SelectionSet.Selections, map[string]bool{})
+	if err != nil {
+		return operation{}, err
+	}
+
+	return operation{
+		action:    opDef.Operation,
+		resources: fields,
+		metrics:   metrics,
+	}, nil
+}
+
+func parseDocument(requestBody string) (*ast.Document, error) {
 	src := source.NewSource(&source.Source{
 		Body: []byte(requestBody),
 		Name: "GraphQL request",
@@ -22,34 +87,286 @@ func parseRequest(requestBody string) (map[string][]string, error) {
 		log.Printf("failed to parse query: %v\n", err)
 		return nil, errors.New("Failed to parse query " + requestBody)
 	}
+	return queryAST, nil
+}
 
-	for _, def := range queryAST.Definitions {
-		if operation, ok := def.(*ast.OperationDefinition); ok {
-			opType := operation.Operation
-			fields := extractFields("", operation.SelectionSet.Selections)
-			fieldMap[opType] = fields
+func collectFragments(document *ast.Document) map[string]*ast.FragmentDefinition {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range document.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
 		}
 	}
+	return fragments
+}
 
-	return fieldMap, nil
+// selectOperation picks the operation that will be executed, following the GetOperation
+// algorithm of the GraphQL spec: without an operationName the document must contain exactly
+// one operation, otherwise the operation with that name must exist.
+func selectOperation(document *ast.Document, operationName string) (*ast.OperationDefinition, error) {
+	var selected *ast.OperationDefinition
+	for _, def := range document.Definitions {
+		opDef, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" {
+			if selected != nil {
+				return nil, errors.New("must provide operation name if query contains multiple operations")
+			}
+			selected = opDef
+			continue
+		}
+		if opDef.Name != nil && opDef.Name.Value == operationName {
+			return opDef, nil
+		}
+	}
+
+	if selected == nil {
+		if operationName != "" {
+			return nil, fmt.Errorf("unknown operation named %s", operationName)
+		}
+		return nil, errors.New("must provide an operation")
+	}
+	return selected, nil
+}
+
+const typenameField = "__typename"
+
+// IsIntrospectionResource reports whether the resource is one of the introspection fields of the
+// query root. Their selections are not walked, __schema and __type are authorized as a whole.
+func IsIntrospectionResource(resource string) bool {
+	return resource == "__schema" || resource == "__type"
+}
+
+// maxExpandedSelections bounds the selections visited with fragments expanded. Fragments spreading
+// others several times grow exponentially, so small documents could otherwise take forever to walk.
+const maxExpandedSelections = 20000
+
+var errTooManySelections = fmt.Errorf("query selects more than %d fields with its fragments expanded", maxExpandedSelections)
+
+// fieldExtractor walks the selections of an operation. budget is the number of selections
+// that may still be visited before the walk is aborted.
+type fieldExtractor struct {
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	budget    int
 }
 
-func extractFields(prefix string, selections []ast.Selection) []string {
-	var fields []string
+// fieldContext is what a field inherits from the fields it is selected in.
+type fieldContext struct {
+	responsePath string
+	typeFields   []string
+	arguments    map[string]interface{}
+	directives   []string
+}
+
+// child returns the context for the selections of the field with the given qualified name.
+func (fe *fieldExtractor) child(ctx fieldContext, parent graphql.Type, qualifiedName string, field *ast.Field) fieldContext {
+	result := ctx
+	result.responsePath = joinPath(ctx.responsePath, responseKey(field))
+	result.directives = withDirectives(ctx.directives, field.Directives)
+	if parent != nil {
+		result.typeFields = append(append([]string{}, ctx.typeFields...), parent.Name()+"."+field.Name.Value)
+		// fields of interfaces are resolved by the types implementing them, which statements may name instead
+		if iface, ok := parent.(*graphql.Interface); ok && fe.schema != nil {
+			for _, implementation := range fe.schema.PossibleTypes(iface) {
+				result.typeFields = append(result.typeFields, implementation.Name()+"."+field.Name.Value)
+			}
+		}
+	}
+	if len(field.Arguments) > 0 {
+		result.arguments = make(map[string]interface{}, len(ctx.arguments)+len(field.Arguments))
+		for key, value := range ctx.arguments {
+			result.arguments[key] = value
+		}
+		for _, argument := range field.Arguments {
+			result.arguments[qualifiedName+"."+argument.Name.Value] = valueFromAST(argument.Value, fe.variables)
+		}
+	}
+	return result
+}
+
+// extract walks the selections and returns the qualified paths of all leaf fields.
+// Fragment spreads are resolved against the fragment definitions of the document,
+// visiting holds the fragments on the current spread chain to detect cycles.
+// parent is the type the selections are made on, nil if the schema is unknown.
+// Selections skipped by @skip or @include are left out since they are never executed.
+// A field whose selections yield no resources, e.g. since they only select __typename,
+// is a resource itself, as it is still resolved by the server.
+func (fe *fieldExtractor) extract(prefix string, parent graphql.Type, ctx fieldContext, selections []ast.Selection, visiting map[string]bool) ([]resource, error) {
+	var fields []resource
 	for _, selection := range selections {
+		fe.budget--
+		if fe.budget < 0 {
+			return nil, errTooManySelections
+		}
 		switch sel := selection.(type) {
 		case *ast.Field:
+			if !executed(sel.Directives, fe.variables) {
+				continue
+			}
+			if sel.Name.Value == typenameField && prefix != "" {
+				// __typename is answered for every type and exposes nothing worth authorizing
+				// below a field, on its own at the root it is the only field of the operation
+				continue
+			}
 			qualifiedName := prefix + sel.Name.Value
-			if sel.GetSelectionSet() != nil && len(sel.GetSelectionSet().Selections) > 0 {
-				fields = append(fields, extractFields(qualifiedName+".", sel.SelectionSet.Selections)...)
-			} else {
-				fields = append(fields, qualifiedName)
+			fieldCtx := fe.child(ctx, parent, qualifiedName, sel)
+			leaf := qualifiedName == typenameField || (prefix == "" && IsIntrospectionResource(qualifiedName))
+			if !leaf && sel.GetSelectionSet() != nil && len(sel.GetSelectionSet().Selections) > 0 {
+				subFields, err := fe.extract(qualifiedName+".", fieldType(parent, sel.Name.Value), fieldCtx, sel.SelectionSet.Selections, visiting)
+				if err != nil {
+					return nil, err
+				}
+				if len(subFields) > 0 {
+					fields = append(fields, subFields...)
+					continue
+				}
 			}
+			fields = append(fields, resource{
+				path:         qualifiedName,
+				responsePath: fieldCtx.responsePath,
+				typeFields:   fieldCtx.typeFields,
+				arguments:    fieldCtx.arguments,
+				directives:   fieldCtx.directives,
+			})
 		case *ast.InlineFragment:
-			fields = append(fields, extractFields(prefix, sel.SelectionSet.Selections)...)
+			if !executed(sel.Directives, fe.variables) {
+				continue
+			}
+			fragmentCtx := ctx
+			fragmentCtx.directives = withDirectives(ctx.directives, sel.Directives)
+			subFields, err := fe.extract(prefix, fe.typeCondition(parent, sel.TypeCondition), fragmentCtx, sel.SelectionSet.Selections, visiting)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, subFields...)
 		case *ast.FragmentSpread:
-			fields = append(fields, prefix+sel.Name.Value)
+			if !executed(sel.Directives, fe.variables) {
+				continue
+			}
+			name := sel.Name.Value
+			fragment, ok := fe.fragments[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %s", name)
+			}
+			if visiting[name] {
+				return nil, fmt.Errorf("cannot spread fragment %s within itself", name)
+			}
+			visiting[name] = true
+			fragmentCtx := ctx
+			fragmentCtx.directives = withDirectives(withDirectives(ctx.directives, sel.Directives), fragment.Directives)
+			subFields, err := fe.extract(prefix, fe.typeCondition(parent, fragment.TypeCondition), fragmentCtx, fragment.SelectionSet.Selections, visiting)
+			delete(visiting, name)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, subFields...)
+		}
+	}
+	return fields, nil
+}
+
+// typeCondition returns the type selections of a fragment are made on, the parent if the fragment has no condition.
+func (fe *fieldExtractor) typeCondition(parent graphql.Type, condition *ast.Named) graphql.Type {
+	if fe.schema == nil || condition == nil {
+		return parent
+	}
+	return fe.schema.Type(condition.Name.Value)
+}
+
+func joinPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func rootType(schema *graphql.Schema, action string) graphql.Type {
+	if schema == nil {
+		return nil
+	}
+	var root *graphql.Object
+	switch action {
+	case ast.OperationTypeQuery:
+		root = schema.QueryType()
+	case ast.OperationTypeMutation:
+		root = schema.MutationType()
+	case ast.OperationTypeSubscription:
+		root = schema.SubscriptionType()
+	}
+	if root == nil {
+		return nil
+	}
+	return root
+}
+
+// fieldType returns the named type of a field, nil if the parent has no such field.
+func fieldType(parent graphql.Type, name string) graphql.Type {
+	var fields graphql.FieldDefinitionMap
+	switch t := parent.(type) {
+	case *graphql.Object:
+		fields = t.Fields()
+	case *graphql.Interface:
+		fields = t.Fields()
+	}
+	definition, ok := fields[name]
+	if !ok {
+		return nil
+	}
+	named, _ := graphql.GetNamed(definition.Type).(graphql.Type)
+	return named
+}
+
+// variableValues returns the variables of the request completed by the defaults of the operation.
+func variableValues(opDef *ast.OperationDefinition, variables map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		values[name] = value
+	}
+	for _, definition := range opDef.VariableDefinitions {
+		name := definition.Variable.Name.Value
+		if _, ok := values[name]; !ok && definition.DefaultValue != nil {
+			values[name] = valueFromAST(definition.DefaultValue, nil)
+		}
+	}
+	return values
+}
+
+// valueFromAST converts a literal to the value it would have in the JSON variables of a request.
+func valueFromAST(value ast.Value, variables map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case *ast.Variable:
+		return variables[v.Name.Value]
+	case *ast.IntValue:
+		if i, err := strconv.Atoi(v.Value); err == nil {
+			return i
+		}
+		f, _ := strconv.ParseFloat(v.Value, 64)
+		return f
+	case *ast.FloatValue:
+		f, _ := strconv.ParseFloat(v.Value, 64)
+		return f
+	case *ast.StringValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.ListValue:
+		list := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			list[i] = valueFromAST(item, variables)
+		}
+		return list
+	case *ast.ObjectValue:
+		object := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			object[field.Name.Value] = valueFromAST(field.Value, variables)
 		}
+		return object
 	}
-	return fields
+	return nil
 }
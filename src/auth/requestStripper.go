@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/printer"
+)
+
+var ErrNothingAllowed = errors.New("none of the requested fields are allowed")
+
+// StrippedField is a field that was removed from a request because it was denied.
+// Path holds the response keys leading to the field, so aliases are used where present.
+type StrippedField struct {
+	Resource string
+	Path     []string
+}
+
+type requestStripper struct {
+	denied    map[string]bool
+	fragments map[string]*ast.FragmentDefinition
+	stripped  []StrippedField
+}
+
+// StripDenied rewrites the operation selected by operationName so that it no longer selects the
+// resources the decision denied. Fragment spreads are inlined since the same fragment may be
+// denied in one place and allowed in another, variables no longer used are dropped.
+// ErrNothingAllowed is returned if no field of the operation is left.
+func StripDenied(requestBody string, operationName string, decision Decision) (string, []StrippedField, error) {
+	document, err := parseDocument(requestBody)
+	if err != nil {
+		return "", nil, err
+	}
+
+	opDef, err := selectOperation(document, operationName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	denied := make(map[string]bool)
+	for _, resource := range decision.DeniedResources() {
+		denied[resource] = true
+	}
+
+	rs := requestStripper{
+		denied:    denied,
+		fragments: collectFragments(document),
+	}
+
+	selections, err := rs.stripSelections("", nil, opDef.SelectionSet.Selections, map[string]bool{})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(selections) == 0 {
+		return "", rs.stripped, ErrNothingAllowed
+	}
+
+	stripped := *opDef
+	stripped.SelectionSet = ast.NewSelectionSet(&ast.SelectionSet{Selections: selections})
+	stripped.VariableDefinitions = usedVariableDefinitions(&stripped)
+
+	printed, ok := printer.Print(ast.NewDocument(&ast.Document{Definitions: []ast.Node{&stripped}})).(string)
+	if !ok {
+		return "", nil, errors.New("failed to print stripped query")
+	}
+	return printed, rs.stripped, nil
+}
+
+func (rs *requestStripper) stripSelections(prefix string, path []string, selections []ast.Selection, visiting map[string]bool) ([]ast.Selection, error) {
+	var result []ast.Selection
+	for _, selection := range selections {
+		switch sel := selection.(type) {
+		case *ast.Field:
+			qualifiedName := prefix + sel.Name.Value
+			fieldPath := appendPath(path, responseKey(sel))
+
+			// root introspection fields are a single resource like in the parser
+			introspection := prefix == "" && IsIntrospectionResource(qualifiedName)
+			if introspection || sel.GetSelectionSet() == nil || len(sel.GetSelectionSet().Selections) == 0 {
+				if rs.denied[qualifiedName] {
+					rs.stripped = append(rs.stripped, StrippedField{Resource: qualifiedName, Path: fieldPath})
+					continue
+				}
+				result = append(result, sel)
+				continue
+			}
+
+			// fields whose selections yield no resources are resources themselves
+			if rs.denied[qualifiedName] {
+				rs.stripped = append(rs.stripped, StrippedField{Resource: qualifiedName, Path: fieldPath})
+				continue
+			}
+
+			strippedCount := len(rs.stripped)
+			subSelections, err := rs.stripSelections(qualifiedName+".", fieldPath, sel.SelectionSet.Selections, visiting)
+			if err != nil {
+				return nil, err
+			}
+			if len(subSelections) == 0 {
+				// report the field itself instead of all of its children
+				rs.stripped = append(rs.stripped[:strippedCount], StrippedField{Resource: qualifiedName, Path: fieldPath})
+				continue
+			}
+			field := *sel
+			field.SelectionSet = ast.NewSelectionSet(&ast.SelectionSet{Selections: subSelections})
+			result = append(result, &field)
+		case *ast.InlineFragment:
+			subSelections, err := rs.stripSelections(prefix, path, sel.SelectionSet.Selections, visiting)
+			if err != nil {
+				return nil, err
+			}
+			if len(subSelections) == 0 {
+				continue
+			}
+			fragment := *sel
+			fragment.SelectionSet = ast.NewSelectionSet(&ast.SelectionSet{Selections: subSelections})
+			result = append(result, &fragment)
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			fragmentDef, ok := rs.fragments[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %s", name)
+			}
+			if visiting[name] {
+				return nil, fmt.Errorf("cannot spread fragment %s within itself", name)
+			}
+			visiting[name] = true
+			subSelections, err := rs.stripSelections(prefix, path, fragmentDef.SelectionSet.Selections, visiting)
+			delete(visiting, name)
+			if err != nil {
+				return nil, err
+			}
+			if len(subSelections) == 0 {
+				continue
+			}
+			result = append(result, ast.NewInlineFragment(&ast.InlineFragment{
+				TypeCondition: fragmentDef.TypeCondition,
+				Directives:    sel.Directives,
+				SelectionSet:  ast.NewSelectionSet(&ast.SelectionSet{Selections: subSelections}),
+			}))
+		}
+	}
+	return result, nil
+}
+
+func responseKey(field *ast.Field) string {
+	if field.Alias != nil && field.Alias.Value != "" {
+		return field.Alias.Value
+	}
+	return field.Name.Value
+}
+
+func appendPath(path []string, key string) []string {
+	result := make([]string, len(path), len(path)+1)
+	copy(result, path)
+	return append(result, key)
+}
+
+// usedVariableDefinitions drops the variable definitions no longer referenced by the operation,
+// servers reject operations that define unused variables.
+func usedVariableDefinitions(opDef *ast.OperationDefinition) []*ast.VariableDefinition {
+	used := make(map[string]bool)
+	collectDirectiveVariables(opDef.Directives, used)
+	collectSelectionVariables(opDef.SelectionSet.Selections, used)
+
+	var definitions []*ast.VariableDefinition
+	for _, definition := range opDef.VariableDefinitions {
+		if used[definition.Variable.Name.Value] {
+			definitions = append(definitions, definition)
+		}
+	}
+	return definitions
+}
+
+func collectSelectionVariables(selections []ast.Selection, used map[string]bool) {
+	for _, selection := range selections {
+		switch sel := selection.(type) {
+		case *ast.Field:
+			for _, argument := range sel.Arguments {
+				collectValueVariables(argument.Value, used)
+			}
+			collectDirectiveVariables(sel.Directives, used)
+			if sel.SelectionSet != nil {
+				collectSelectionVariables(sel.SelectionSet.Selections, used)
+			}
+		case *ast.InlineFragment:
+			collectDirectiveVariables(sel.Directives, used)
+			collectSelectionVariables(sel.SelectionSet.Selections, used)
+		}
+	}
+}
+
+func collectDirectiveVariables(directives []*ast.Directive, used map[string]bool) {
+	for _, directive := range directives {
+		for _, argument := range directive.Arguments {
+			collectValueVariables(argument.Value, used)
+		}
+	}
+}
+
+func collectValueVariables(value ast.Value, used map[string]bool) {
+	switch v := value.(type) {
+	case *ast.Variable:
+		used[v.Name.Value] = true
+	case *ast.ListValue:
+		for _, item := range v.Values {
+			collectValueVariables(item, used)
+		}
+	case *ast.ObjectValue:
+		for _, field := range v.Fields {
+			collectValueVariables(field.Value, used)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"github.com/graphql-iam/agent/src/model"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStripDenied(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	query := `
+query Data($id: ID, $withTitle: Boolean) {
+  testData(id: $id) {
+	data {
+      name
+	  heading: title @include(if: $withTitle)
+	}
+	secret {
+	  value
+	}
+	...More
+  }
+}
+
+fragment More on TestData {
+  other
+}
+`
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     query,
+		Claims:    map[string]interface{}{},
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowAll",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"**"},
+						Condition: nil,
+					},
+					{
+						Sid:       "denyTitleAndSecret",
+						Action:    model.Patterns{"query"},
+						Effect:    "deny",
+						Resource:  model.Patterns{"testData.{data.title,secret.*}"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	decision := pe.EvaluateRoles([]model.Role{testRole})
+	if decision.Allowed {
+		t.Fatal("Expected Result to be false")
+	}
+
+	stripped, fields, err := StripDenied(query, "", decision)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if strings.Contains(stripped, "title") || strings.Contains(stripped, "secret") || strings.Contains(stripped, "withTitle") {
+		t.Fatalf("Expected denied fields and unused variables to be removed, got %s", stripped)
+	}
+	if !strings.Contains(stripped, "name") || !strings.Contains(stripped, "other") || !strings.Contains(stripped, "$id") {
+		t.Fatalf("Expected allowed fields to be kept, got %s", stripped)
+	}
+
+	if len(fields) != 2 {
+		t.Fatalf("Expected two stripped fields, got %v", fields)
+	}
+	if fields[0].Resource != "testData.data.title" || strings.Join(fields[0].Path, ".") != "testData.data.heading" {
+		t.Fatalf("Expected aliased title to be stripped, got %+v", fields[0])
+	}
+	if fields[1].Resource != "testData.secret" {
+		t.Fatalf("Expected secret to be stripped as a whole, got %+v", fields[1])
+	}
+
+	restricted := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     `query { testData { secret { value } } }`,
+		Claims:    map[string]interface{}{},
+	}
+	decision = restricted.EvaluateRoles([]model.Role{testRole})
+
+	_, _, err = StripDenied(restricted.Query, "", decision)
+	if err != ErrNothingAllowed {
+		t.Fatalf("Expected ErrNothingAllowed, got %v", err)
+	}
+}
+
+func TestStripDenied_Introspection(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://testing.com/graphql", nil)
+	query := `{ __schema { types { name } } secret public }`
+
+	pe := PolicyEvaluator{
+		Request:   *request,
+		Variables: map[string]interface{}{},
+		Query:     query,
+		Claims:    map[string]interface{}{},
+	}
+
+	testRole := model.Role{
+		Name: "test",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "test",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:       "allowPublic",
+						Action:    model.Patterns{"query"},
+						Effect:    "allow",
+						Resource:  model.Patterns{"public"},
+						Condition: nil,
+					},
+				},
+			},
+		},
+	}
+
+	decision := pe.EvaluateRoles([]model.Role{testRole})
+
+	stripped, fields, err := StripDenied(query, "", decision)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Contains(stripped, "__schema") || strings.Contains(stripped, "secret") {
+		t.Fatalf("Expected the introspection and secret to be removed, got %s", stripped)
+	}
+	if len(fields) != 2 || fields[0].Resource != "__schema" || fields[1].Resource != "secret" {
+		t.Fatalf("Expected __schema to be stripped as a whole, got %+v", fields)
+	}
+}
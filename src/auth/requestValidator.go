@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/printer"
+	"github.com/graphql-go/graphql/language/source"
+	"math"
+	"slices"
+	"strings"
+)
+
+// ValidateRequest checks the request against the schema with the validation rules of the GraphQL
+// spec and makes sure every required variable of the selected operation has a value of its type.
+// The errors carry the locations of the offending nodes like the errors of a GraphQL server.
+func ValidateRequest(requestBody string, operationName string, variables map[string]interface{}, schema *graphql.Schema) []gqlerrors.FormattedError {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(requestBody),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		return gqlerrors.FormatErrors(err)
+	}
+
+	result := graphql.ValidateDocument(schema, document, graphql.SpecifiedRules)
+	if !result.IsValid {
+		return result.Errors
+	}
+
+	opDef, err := selectOperation(document, operationName)
+	if err != nil {
+		return gqlerrors.FormatErrors(err)
+	}
+	if errs := missingVariables(opDef, variables); len(errs) > 0 {
+		return errs
+	}
+	return invalidVariables(opDef, variables, schema)
+}
+
+func missingVariables(opDef *ast.OperationDefinition, variables map[string]interface{}) []gqlerrors.FormattedError {
+	var errs []gqlerrors.FormattedError
+	for _, definition := range opDef.VariableDefinitions {
+		_, required := definition.Type.(*ast.NonNull)
+		name := definition.Variable.Name.Value
+		if !required || definition.DefaultValue != nil || variables[name] != nil {
+			continue
+		}
+		message := fmt.Sprintf("Variable \"$%s\" of required type \"%s\" was not provided.", name, printer.Print(definition.Type))
+		errs = append(errs, gqlerrors.FormatError(gqlerrors.NewError(message, []ast.Node{definition}, "", nil, nil, nil)))
+	}
+	return errs
+}
+
+// invalidVariables checks the values of the variables against their declared types, as a GraphQL
+// server would before executing the operation. Custom scalars are left to the upstream server.
+func invalidVariables(opDef *ast.OperationDefinition, variables map[string]interface{}, schema *graphql.Schema) []gqlerrors.FormattedError {
+	var errs []gqlerrors.FormattedError
+	for _, definition := range opDef.VariableDefinitions {
+		name := definition.Variable.Name.Value
+		value := variables[name]
+		ttype, ok := inputTypeFromAST(schema, definition.Type)
+		if value == nil || !ok {
+			continue
+		}
+		problems := inputValueProblems(value, ttype)
+		if len(problems) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("Variable \"$%s\" got invalid value %s.\n%s", name, printValue(value), strings.Join(problems, "\n"))
+		errs = append(errs, gqlerrors.FormatError(gqlerrors.NewError(message, []ast.Node{definition}, "", nil, nil, nil)))
+	}
+	return errs
+}
+
+func inputTypeFromAST(schema *graphql.Schema, typeAST ast.Type) (graphql.Input, bool) {
+	switch t := typeAST.(type) {
+	case *ast.NonNull:
+		ofType, ok := inputTypeFromAST(schema, t.Type)
+		return graphql.NewNonNull(ofType), ok
+	case *ast.List:
+		ofType, ok := inputTypeFromAST(schema, t.Type)
+		return graphql.NewList(ofType), ok
+	case *ast.Named:
+		ttype, ok := schema.Type(t.Name.Value).(graphql.Input)
+		return ttype, ok && graphql.IsInputType(ttype)
+	}
+	return nil, false
+}
+
+// inputValueProblems describes why the value can't be coerced to the input type.
+func inputValueProblems(value interface{}, ttype graphql.Input) []string {
+	if value == nil {
+		if nonNull, ok := ttype.(*graphql.NonNull); ok {
+			return []string{fmt.Sprintf("Expected \"%s\", found null.", nonNull.String())}
+		}
+		return nil
+	}
+
+	switch t := ttype.(type) {
+	case *graphql.NonNull:
+		return inputValueProblems(value, t.OfType)
+	case *graphql.List:
+		elements, ok := value.([]interface{})
+		if !ok {
+			return inputValueProblems(value, t.OfType)
+		}
+		var problems []string
+		for i, element := range elements {
+			for _, problem := range inputValueProblems(element, t.OfType) {
+				problems = append(problems, fmt.Sprintf("In element #%d: %s", i+1, problem))
+			}
+		}
+		return problems
+	case *graphql.InputObject:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("Expected \"%s\", found not an object.", t.Name())}
+		}
+		fields := t.Fields()
+		var problems []string
+		for name := range object {
+			if _, ok := fields[name]; !ok {
+				problems = append(problems, fmt.Sprintf("In field \"%s\": Unknown field.", name))
+			}
+		}
+		for name, field := range fields {
+			if _, provided := object[name]; !provided && field.DefaultValue != nil {
+				continue
+			}
+			for _, problem := range inputValueProblems(object[name], field.Type) {
+				problems = append(problems, fmt.Sprintf("In field \"%s\": %s", name, problem))
+			}
+		}
+		slices.Sort(problems)
+		return problems
+	case *graphql.Enum:
+		if name, ok := value.(string); !ok || t.ParseValue(name) == nil {
+			return []string{fmt.Sprintf("Expected type \"%s\", found %s.", t.Name(), printValue(value))}
+		}
+	case *graphql.Scalar:
+		if !validScalarValue(t, value) {
+			return []string{fmt.Sprintf("Expected type \"%s\", found %s.", t.Name(), printValue(value))}
+		}
+	}
+	return nil
+}
+
+// validScalarValue checks values of the built-in scalars as decoded from JSON.
+func validScalarValue(scalar *graphql.Scalar, value interface{}) bool {
+	switch scalar {
+	case graphql.String:
+		_, ok := value.(string)
+		return ok
+	case graphql.Boolean:
+		_, ok := value.(bool)
+		return ok
+	case graphql.Float:
+		_, ok := numberValue(value)
+		return ok
+	case graphql.Int:
+		number, ok := numberValue(value)
+		return ok && number == math.Trunc(number) && number >= math.MinInt32 && number <= math.MaxInt32
+	case graphql.ID:
+		if _, ok := value.(string); ok {
+			return true
+		}
+		number, ok := numberValue(value)
+		return ok && number == math.Trunc(number)
+	}
+	return scalar.ParseValue(value) != nil
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func printValue(value interface{}) string {
+	printed, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(printed)
+}
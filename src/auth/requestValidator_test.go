@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"github.com/graphql-iam/agent/src/schema"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	testSchema, err := schema.FromSDL(`
+type User {
+  id: ID!
+  name: String
+}
+
+enum Role {
+  ADMIN
+  USER
+}
+
+input UserFilter {
+  role: Role
+  limit: Int
+  names: [String!]
+}
+
+type Query {
+  user(id: ID!): User
+  users(filter: UserFilter): [User]
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		error     string
+	}{
+		{
+			name:  "valid",
+			query: `query { user(id: "1") { name } }`,
+		},
+		{
+			name:  "unknown field",
+			query: `query { user(id: "1") { email } }`,
+			error: `Cannot query field "email" on type "User".`,
+		},
+		{
+			name:  "wrong argument type",
+			query: `query { user(id: 1.5) { name } }`,
+			error: `Argument "id" has invalid value 1.5.`,
+		},
+		{
+			name:  "missing variable",
+			query: `query User($id: ID!) { user(id: $id) { name } }`,
+			error: `Variable "$id" of required type "ID!" was not provided.`,
+		},
+		{
+			name:      "provided variable",
+			query:     `query User($id: ID!) { user(id: $id) { name } }`,
+			variables: map[string]interface{}{"id": "1"},
+		},
+		{
+			name:      "object for an id",
+			query:     `query User($id: ID!) { user(id: $id) { name } }`,
+			variables: map[string]interface{}{"id": map[string]interface{}{"x": float64(1)}},
+			error:     `Variable "$id" got invalid value {"x":1}.`,
+		},
+		{
+			name:      "number for an id",
+			query:     `query User($id: ID!) { user(id: $id) { name } }`,
+			variables: map[string]interface{}{"id": float64(1)},
+		},
+		{
+			name:      "valid input object",
+			query:     `query Users($filter: UserFilter) { users(filter: $filter) { name } }`,
+			variables: map[string]interface{}{"filter": map[string]interface{}{"role": "ADMIN", "limit": float64(10), "names": []interface{}{"a"}}},
+		},
+		{
+			name:      "unknown enum value",
+			query:     `query Users($filter: UserFilter) { users(filter: $filter) { name } }`,
+			variables: map[string]interface{}{"filter": map[string]interface{}{"role": "OWNER"}},
+			error:     `In field "role": Expected type "Role", found "OWNER".`,
+		},
+		{
+			name:      "unknown input field",
+			query:     `query Users($filter: UserFilter) { users(filter: $filter) { name } }`,
+			variables: map[string]interface{}{"filter": map[string]interface{}{"email": "a@b.c"}},
+			error:     `In field "email": Unknown field.`,
+		},
+		{
+			name:      "fractional int",
+			query:     `query Users($filter: UserFilter) { users(filter: $filter) { name } }`,
+			variables: map[string]interface{}{"filter": map[string]interface{}{"limit": 1.5}},
+			error:     `In field "limit": Expected type "Int", found 1.5.`,
+		},
+		{
+			name:      "null list element",
+			query:     `query Users($filter: UserFilter) { users(filter: $filter) { name } }`,
+			variables: map[string]interface{}{"filter": map[string]interface{}{"names": []interface{}{"a", nil}}},
+			error:     `In field "names": In element #2: Expected "String!", found null.`,
+		},
+		{
+			name:  "syntax error",
+			query: `query { user(id: "1") { name }`,
+			error: "Syntax Error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := ValidateRequest(test.query, "", test.variables, testSchema)
+			if test.error == "" {
+				if len(errs) != 0 {
+					t.Fatalf("Expected no errors, got %v", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errs[0].Message, test.error) {
+				t.Fatalf("Expected error %q, got %v", test.error, errs)
+			}
+			if len(errs[0].Locations) == 0 {
+				t.Fatalf("Expected error to have a location, got %v", errs[0])
+			}
+		})
+	}
+}
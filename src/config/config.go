@@ -2,20 +2,138 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"io"
 	"os"
+	"strings"
 )
 
+// Config is read from the config file at startup. LegacyEvaluation switches to the policy evaluation
+// of earlier versions, where a request is allowed if any role allows it on its own.
 type Config struct {
-	Port         int          `yaml:"port"`
-	Path         string       `yaml:"path"`
-	ManagerUrl   string       `yaml:"managerUrl"`
-	SourceUrl    string       `yaml:"sourceUrl"`
-	MongoUrl     string       `yaml:"mongoUrl"`
-	Auth         AuthOptions  `yaml:"auth"`
-	CacheOptions CacheOptions `yaml:"cacheOptions"`
-	CorsOptions  CorsOptions  `yaml:"corsOptions"`
+	Port             int                   `yaml:"port"`
+	Path             string                `yaml:"path"`
+	ManagerUrl       string                `yaml:"managerUrl"`
+	SourceUrl        string                `yaml:"sourceUrl"`
+	MongoUrl         string                `yaml:"mongoUrl"`
+	Auth             AuthOptions           `yaml:"auth"`
+	DenyMode         string                `yaml:"denyMode"`
+	Subscriptions    SubscriptionOptions   `yaml:"subscriptions"`
+	Batching         BatchOptions          `yaml:"batching"`
+	Upstream         UpstreamOptions       `yaml:"upstream"`
+	Schema           SchemaOptions         `yaml:"schema"`
+	Limits           QueryLimits           `yaml:"limits"`
+	Introspection    IntrospectionOptions  `yaml:"introspection"`
+	PersistedQueries PersistedQueryOptions `yaml:"persistedQueries"`
+	Routes           []Route               `yaml:"routes"`
+	LegacyEvaluation bool                  `yaml:"legacyEvaluation"`
+	Boundaries       BoundaryOptions       `yaml:"boundaries"`
+	CacheOptions     CacheOptions          `yaml:"cacheOptions"`
+	CorsOptions      CorsOptions           `yaml:"corsOptions"`
+	ErrorOptions     ErrorOptions          `yaml:"errorOptions"`
+	Debug            bool                  `yaml:"debug"`
+}
+
+// Route maps requests on a path, optionally restricted to a host or header value, to an upstream.
+// Fields left empty are taken from the top level of the config.
+type Route struct {
+	Name            string        `yaml:"name"`
+	Path            string        `yaml:"path"`
+	Host            string        `yaml:"host"`
+	Header          HeaderMatch   `yaml:"header"`
+	SourceUrl       string        `yaml:"sourceUrl"`
+	SubscriptionUrl string        `yaml:"subscriptionUrl"`
+	Auth            AuthOptions   `yaml:"auth"`
+	DenyMode        string        `yaml:"denyMode"`
+	PolicyNamespace string        `yaml:"policyNamespace"`
+	Schema          SchemaOptions `yaml:"schema"`
+}
+
+// HeaderMatch matches requests carrying the header, with the given value if one is set.
+type HeaderMatch struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// SchemaOptions configure where the schema of the upstream is loaded from at startup,
+// either an SDL file at path or by sending an introspection query with the given headers.
+// With validate set requests are validated against the schema before they are authorized.
+type SchemaOptions struct {
+	Path       string            `yaml:"path"`
+	Introspect bool              `yaml:"introspect"`
+	Headers    map[string]string `yaml:"headers"`
+	Validate   bool              `yaml:"validate"`
+}
+
+// IntrospectionOptions either reject every introspection query or filter introspection results
+// down to the fields the policies of the caller allow.
+type IntrospectionOptions struct {
+	Block  bool `yaml:"block"`
+	Filter bool `yaml:"filter"`
+}
+
+// PersistedQueryOptions enable Automatic Persisted Queries, where clients send the sha256 hash
+// of a query instead of the query once it was registered. The manifest at manifestPath holds
+// known queries, with allowList set only its queries are accepted and none can be registered.
+type PersistedQueryOptions struct {
+	Enabled      bool   `yaml:"enabled"`
+	ManifestPath string `yaml:"manifestPath"`
+	AllowList    bool   `yaml:"allowList"`
+}
+
+// BoundaryOptions name the boundary policies no role can exceed, read from a JSON file with a list
+// of policies at path and taken from the roles of the manager's default namespace named in roles.
+type BoundaryOptions struct {
+	Path  string   `yaml:"path"`
+	Roles []string `yaml:"roles"`
+}
+
+// QueryLimits reject operations exceeding them before any policy is evaluated, 0 disables a limit.
+// MaxDuplicateFields limits how often a single field may be selected under different aliases.
+type QueryLimits struct {
+	MaxDepth           int `yaml:"maxDepth"`
+	MaxFields          int `yaml:"maxFields"`
+	MaxAliases         int `yaml:"maxAliases"`
+	MaxCost            int `yaml:"maxCost"`
+	MaxDuplicateFields int `yaml:"maxDuplicateFields"`
+}
+
+type UpstreamOptions struct {
+	TimeoutSec               int        `yaml:"timeoutSec"`
+	DialTimeoutSec           int        `yaml:"dialTimeoutSec"`
+	ResponseHeaderTimeoutSec int        `yaml:"responseHeaderTimeoutSec"`
+	IdleConnTimeoutSec       int        `yaml:"idleConnTimeoutSec"`
+	MaxIdleConns             int        `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost      int        `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost          int        `yaml:"maxConnsPerHost"`
+	Retries                  int        `yaml:"retries"`
+	Tls                      TlsOptions `yaml:"tls"`
+}
+
+type TlsOptions struct {
+	CaPath             string `yaml:"caPath"`
+	CertPath           string `yaml:"certPath"`
+	KeyPath            string `yaml:"keyPath"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+const (
+	BatchModeReject = "reject"
+	BatchModeFilter = "filter"
+)
+
+type BatchOptions struct {
+	Enabled bool   `yaml:"enabled"`
+	Mode    string `yaml:"mode"`
+	MaxSize int    `yaml:"maxSize"`
+}
+
+type SubscriptionOptions struct {
+	Enabled        bool   `yaml:"enabled"`
+	SourceUrl      string `yaml:"sourceUrl"`
+	InitTimeoutSec int    `yaml:"initTimeoutSec"`
 }
 
 type CorsOptions struct {
@@ -24,6 +142,20 @@ type CorsOptions struct {
 	AllowHeaders []string `yaml:"allowHeaders"`
 }
 
+const (
+	DenyModeReject = "reject"
+	DenyModeStrip  = "strip"
+)
+
+const (
+	StatusModeHttp = "http"
+	StatusModeOk   = "ok"
+)
+
+type ErrorOptions struct {
+	StatusMode string `yaml:"statusMode"`
+}
+
 type CacheOptions struct {
 	Expiration int `yaml:"expiration"`
 	Purge      int `yaml:"purge"`
@@ -78,35 +210,104 @@ func (c *Config) validateAndFillDefaults() error {
 	if c.ManagerUrl == "" {
 		return errors.New("no managerUrl provided in config")
 	}
-	if c.SourceUrl == "" {
-		return errors.New("no sourceUrl provided in config")
-	}
 	if c.MongoUrl == "" {
 		return errors.New("no mongoUrl provided in config")
 	}
-	if c.Auth.Mode == "" {
-		return errors.New("no auth provided in config")
-	}
 	if err := c.CacheOptions.validateAndFillDefaults(); err != nil {
 		return err
 	}
-	switch c.Auth.Mode {
-	case "jwt":
-		err := c.Auth.JwtOptions.validateAndFillDefaults()
-		if err != nil {
-			return err
+	if err := c.ErrorOptions.validateAndFillDefaults(); err != nil {
+		return err
+	}
+	if err := c.Subscriptions.validateAndFillDefaults(); err != nil {
+		return err
+	}
+	if err := c.Batching.validateAndFillDefaults(); err != nil {
+		return err
+	}
+	if err := c.Upstream.validateAndFillDefaults(); err != nil {
+		return err
+	}
+	if err := c.Limits.validateAndFillDefaults(); err != nil {
+		return err
+	}
+	if c.Introspection.Block && c.Introspection.Filter {
+		return errors.New("introspection can either be blocked or filtered")
+	}
+	if c.PersistedQueries.AllowList && c.PersistedQueries.ManifestPath == "" {
+		return errors.New("persisted query allow list needs a manifestPath")
+	}
+	if len(c.Routes) == 0 {
+		c.Routes = []Route{{
+			Name:            "default",
+			SubscriptionUrl: c.Subscriptions.SourceUrl,
+		}}
+	}
+	for i := range c.Routes {
+		if c.Routes[i].Name == "" {
+			c.Routes[i].Name = fmt.Sprintf("route%d", i)
 		}
-		break
-	case "header":
-		err := c.Auth.HeaderOptions.validateAndFillDefaults()
-		if err != nil {
-			return err
+		if err := c.Routes[i].validateAndFillDefaults(*c); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
 		}
-		break
+	}
+	return nil
+}
+
+// validateAndFillDefaults fills everything the route leaves out from the top level of the config.
+func (r *Route) validateAndFillDefaults(defaults Config) error {
+	if r.Path == "" {
+		r.Path = defaults.Path
+	}
+	if r.SourceUrl == "" {
+		r.SourceUrl = defaults.SourceUrl
+	}
+	if r.SourceUrl == "" {
+		return errors.New("no sourceUrl provided in config")
+	}
+	if r.SubscriptionUrl == "" {
+		// the upstream websocket endpoint usually shares the url of the http endpoint
+		r.SubscriptionUrl = "ws" + strings.TrimPrefix(r.SourceUrl, "http")
+	}
+	if r.Header.Value != "" && r.Header.Name == "" {
+		return errors.New("no header name provided for route header value")
+	}
+	if r.DenyMode == "" {
+		r.DenyMode = defaults.DenyMode
+	}
+	switch r.DenyMode {
+	case "":
+		r.DenyMode = DenyModeReject
+	case DenyModeReject, DenyModeStrip:
+	default:
+		return errors.New("unknown deny mode provided")
+	}
+	if r.Schema.Path == "" && !r.Schema.Introspect {
+		r.Schema = defaults.Schema
+	}
+	if r.Schema.Path != "" && r.Schema.Introspect {
+		return errors.New("schema can either be loaded from path or by introspection")
+	}
+	if r.Schema.Validate && r.Schema.Path == "" && !r.Schema.Introspect {
+		return errors.New("schema validation needs a schema path or introspection")
+	}
+	if r.Auth.Mode == "" {
+		r.Auth = defaults.Auth
+	}
+	return r.Auth.validateAndFillDefaults()
+}
+
+func (c *AuthOptions) validateAndFillDefaults() error {
+	switch c.Mode {
+	case "":
+		return errors.New("no auth provided in config")
+	case "jwt":
+		return c.JwtOptions.validateAndFillDefaults()
+	case "header":
+		return c.HeaderOptions.validateAndFillDefaults()
 	default:
 		return errors.New("unknown auth mode provided")
 	}
-	return nil
 }
 
 func (c *JwtOptions) validateAndFillDefaults() error {
@@ -136,6 +337,70 @@ func (c *CacheOptions) validateAndFillDefaults() error {
 	return nil
 }
 
+func (c *UpstreamOptions) validateAndFillDefaults() error {
+	if c.DialTimeoutSec <= 0 {
+		c.DialTimeoutSec = 5
+	}
+	if c.ResponseHeaderTimeoutSec <= 0 {
+		c.ResponseHeaderTimeoutSec = 10
+	}
+	if c.IdleConnTimeoutSec <= 0 {
+		c.IdleConnTimeoutSec = 90
+	}
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = 100
+	}
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = 100
+	}
+	if c.Retries < 0 {
+		return errors.New("upstream retries must not be negative")
+	}
+	if (c.Tls.CertPath == "") != (c.Tls.KeyPath == "") {
+		return errors.New("upstream tls needs both certPath and keyPath for client certificates")
+	}
+	return nil
+}
+
+func (c *QueryLimits) validateAndFillDefaults() error {
+	if c.MaxDepth < 0 || c.MaxFields < 0 || c.MaxAliases < 0 || c.MaxCost < 0 || c.MaxDuplicateFields < 0 {
+		return errors.New("query limits must not be negative")
+	}
+	return nil
+}
+
+func (c *BatchOptions) validateAndFillDefaults() error {
+	switch c.Mode {
+	case "":
+		c.Mode = BatchModeReject
+	case BatchModeReject, BatchModeFilter:
+	default:
+		return errors.New("unknown batch mode provided")
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 10
+	}
+	return nil
+}
+
+func (c *SubscriptionOptions) validateAndFillDefaults() error {
+	if c.InitTimeoutSec <= 0 {
+		c.InitTimeoutSec = 10
+	}
+	return nil
+}
+
+func (c *ErrorOptions) validateAndFillDefaults() error {
+	switch c.StatusMode {
+	case "":
+		c.StatusMode = StatusModeHttp
+	case StatusModeHttp, StatusModeOk:
+	default:
+		return errors.New("unknown error status mode provided")
+	}
+	return nil
+}
+
 func getConfig(path string) (Config, error) {
 	var res Config
 
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-iam/agent/src/auth"
+	"github.com/graphql-iam/agent/src/config"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// batchItem is a single operation of a batch, either forwarded upstream or answered with denied.
+type batchItem struct {
+	raw     json.RawMessage
+	action  string
+	rewrite responseRewrite
+	denied  []graphqlError
+}
+
+func isBatch(jsonBytes []byte) bool {
+	trimmed := bytes.TrimSpace(jsonBytes)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// batchHandler authorizes every operation of an array batched request on its own. Depending on the
+// batch mode a denied operation rejects the whole batch or only the allowed operations are forwarded.
+// The response array keeps the order of the request with errors in place of denied operations.
+func (p *PolicyProxy) batchHandler(context *gin.Context, route config.Route, jsonBytes []byte) {
+	if !p.cfg.Batching.Enabled {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadRequest, newGraphqlError("Batched requests are not enabled", codeBadRequest))
+		return
+	}
+
+	var rawItems []json.RawMessage
+	err := json.Unmarshal(jsonBytes, &rawItems)
+	if err != nil || len(rawItems) == 0 {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadRequest, newGraphqlError("Request is not a valid GraphQL batch", codeBadRequest))
+		return
+	}
+	if len(rawItems) > p.cfg.Batching.MaxSize {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadRequest, newGraphqlError(fmt.Sprintf("Batch exceeds the maximum size of %d operations", p.cfg.Batching.MaxSize), codeBadRequest))
+		return
+	}
+
+	rolesStr, claims, err := p.roleResolver.resolveRoles(context.Request.Context(), route.Auth, context.Request.Header)
+	if err != nil {
+		fmt.Printf("Error resolving roles: %v\n", err.Error())
+		abortWithGraphqlErrors(context, p.cfg, http.StatusUnauthorized, newGraphqlError("Could not authenticate request", codeUnauthenticated))
+		return
+	}
+
+	items := make([]batchItem, len(rawItems))
+	anyDenied := false
+	for i, raw := range rawItems {
+		items[i], err = p.authorizeBatchItem(context, route, rolesStr, claims, raw)
+		if err != nil {
+			log.Printf("request was denied with error: %v\n", err)
+			abortWithGraphqlErrors(context, p.cfg, http.StatusInternalServerError, newGraphqlError("Could not authorize request", codeInternalError))
+			return
+		}
+		anyDenied = anyDenied || items[i].denied != nil
+	}
+
+	if anyDenied && p.cfg.Batching.Mode == config.BatchModeReject {
+		p.rejectBatch(context, items)
+		return
+	}
+
+	var forward []json.RawMessage
+	retryable := true
+	for _, item := range items {
+		if item.denied == nil {
+			forward = append(forward, item.raw)
+			retryable = retryable && item.action == "query"
+		}
+	}
+
+	status := http.StatusForbidden
+	if p.cfg.ErrorOptions.StatusMode == config.StatusModeOk {
+		status = http.StatusOK
+	}
+	var upstreamResponses []json.RawMessage
+	if len(forward) > 0 {
+		status, upstreamResponses, err = p.sendBatchUpstream(context, route, forward, retryable)
+		if err != nil {
+			log.Printf("failed to proxy batch: %v\n", err)
+			abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to proxy request", codeInternalError))
+			return
+		}
+	}
+
+	responses := make([]json.RawMessage, len(items))
+	next := 0
+	for i, item := range items {
+		if item.denied != nil {
+			responses[i], _ = json.Marshal(graphqlErrorResponse{Errors: item.denied})
+			continue
+		}
+		responses[i] = upstreamResponses[next]
+		next++
+		if item.rewrite != nil {
+			responses[i], err = item.rewrite(responses[i])
+			if err != nil {
+				abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to read response", codeInternalError))
+				return
+			}
+		}
+	}
+
+	context.JSON(status, responses)
+}
+
+// authorizeBatchItem returns the item to forward, which is stripped of its denied fields in strip mode.
+func (p *PolicyProxy) authorizeBatchItem(context *gin.Context, route config.Route, rolesStr []string, claims map[string]interface{}, raw json.RawMessage) (batchItem, error) {
+	var data policyProxyPostData
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		gqlErr := newGraphqlError("Request is not a valid GraphQL request", codeBadRequest)
+		return batchItem{raw: raw, denied: []graphqlError{gqlErr}}, nil
+	}
+
+	body, _, resolveErr := p.withPersistedQuery(context, &data, raw)
+	if resolveErr != nil {
+		return batchItem{raw: raw, denied: []graphqlError{*resolveErr}}, nil
+	}
+	raw = body
+
+	if gqlErrors := p.validate(route, data); len(gqlErrors) > 0 {
+		return batchItem{raw: raw, denied: gqlErrors}, nil
+	}
+
+	authRequest := p.newAuthRequest(context, route, rolesStr, claims, data)
+	decision, err := p.authService.AuthorizeWithRoles(authRequest)
+	if err != nil {
+		return batchItem{}, err
+	}
+	if decision.Introspection && p.cfg.Introspection.Block {
+		return batchItem{raw: raw, denied: []graphqlError{newIntrospectionDisabledError()}}, nil
+	}
+	rewrite := p.introspectionRewrite(authRequest, decision)
+	if decision.Allowed {
+		return batchItem{raw: raw, action: decision.Action, rewrite: rewrite}, nil
+	}
+
+	log.Printf("Batched operation was denied: %s\n", strings.Join(decision.Reasons(), "; "))
+	if route.DenyMode == config.DenyModeStrip && decision.Error == "" {
+		query, stripped, err := auth.StripDenied(data.Query, data.Operation, decision)
+		if err == nil && len(stripped) > 0 {
+			body, err := replaceStrippedQuery(raw, query)
+			if err != nil {
+				return batchItem{}, err
+			}
+			return batchItem{raw: body, action: decision.Action, rewrite: chainRewrites(strippedFieldsRewrite(stripped), rewrite)}, nil
+		}
+	}
+
+	_, gqlErr := newDeniedError(p.cfg, decision)
+	return batchItem{raw: raw, denied: []graphqlError{gqlErr}}, nil
+}
+
+func (p *PolicyProxy) rejectBatch(context *gin.Context, items []batchItem) {
+	responses := make([]graphqlErrorResponse, len(items))
+	for i, item := range items {
+		if item.denied != nil {
+			responses[i] = graphqlErrorResponse{Errors: item.denied}
+		} else {
+			responses[i] = graphqlErrorResponse{Errors: []graphqlError{newGraphqlError("Not executed because another operation of the batch was denied", codeForbidden)}}
+		}
+	}
+
+	status := http.StatusForbidden
+	if p.cfg.ErrorOptions.StatusMode == config.StatusModeOk {
+		status = http.StatusOK
+	}
+	context.AbortWithStatusJSON(status, responses)
+}
+
+func (p *PolicyProxy) sendBatchUpstream(context *gin.Context, route config.Route, forward []json.RawMessage, retryable bool) (int, []json.RawMessage, error) {
+	body, err := json.Marshal(forward)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	proxyResponse, err := p.sendUpstream(context, route, body, retryable, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer proxyResponse.Body.Close()
+
+	proxyResponseBody, err := io.ReadAll(proxyResponse.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var responses []json.RawMessage
+	err = json.Unmarshal(proxyResponseBody, &responses)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(responses) != len(forward) {
+		return 0, nil, fmt.Errorf("upstream answered %d operations with %d responses", len(forward), len(responses))
+	}
+
+	copyHeaders(context.Writer.Header(), proxyResponse.Header, "Content-Length", "Content-Type")
+	return proxyResponse.StatusCode, responses, nil
+}
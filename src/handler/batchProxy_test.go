@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/graphql-iam/agent/src/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newBatchUpstream answers a batch with the queries it received, leaving out the last ones if drop is set.
+func newBatchUpstream(t *testing.T, drop int) (*httptest.Server, *[][]string) {
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []struct {
+			Query string `json:"query"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&items)
+		var queries []string
+		var responses []string
+		for _, item := range items {
+			queries = append(queries, item.Query)
+			response, _ := json.Marshal(map[string]interface{}{"data": map[string]string{"query": item.Query}})
+			responses = append(responses, string(response))
+		}
+		batches = append(batches, queries)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, "[%s]", strings.Join(responses[:len(responses)-drop], ","))
+	}))
+	t.Cleanup(server.Close)
+	return server, &batches
+}
+
+func TestPolicyProxy_Batch(t *testing.T) {
+	public := "{ public { news } }"
+	account := "{ account { email } }"
+	other := "{ other { name } }"
+
+	tests := []struct {
+		name     string
+		mode     string
+		queries  []string
+		drop     int
+		status   int
+		upstream []string
+		denied   []bool
+	}{
+		{
+			name:     "filter",
+			mode:     config.BatchModeFilter,
+			queries:  []string{public, account, other},
+			status:   http.StatusOK,
+			upstream: []string{public, other},
+			denied:   []bool{false, true, false},
+		},
+		{
+			name:    "filter without allowed operations",
+			mode:    config.BatchModeFilter,
+			queries: []string{account, account},
+			status:  http.StatusForbidden,
+			denied:  []bool{true, true},
+		},
+		{
+			name:    "reject",
+			mode:    config.BatchModeReject,
+			queries: []string{public, account, other},
+			status:  http.StatusForbidden,
+			denied:  []bool{true, true, true},
+		},
+		{
+			name:     "reject without denied operations",
+			mode:     config.BatchModeReject,
+			queries:  []string{public, other},
+			status:   http.StatusOK,
+			upstream: []string{public, other},
+			denied:   []bool{false, false},
+		},
+		{
+			name:     "upstream count mismatch",
+			mode:     config.BatchModeFilter,
+			queries:  []string{public, other},
+			drop:     1,
+			status:   http.StatusBadGateway,
+			upstream: []string{public, other},
+		},
+		{
+			name:    "size limit",
+			mode:    config.BatchModeFilter,
+			queries: []string{public, public, public, public},
+			status:  http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamServer, batches := newBatchUpstream(t, test.drop)
+			cfg := newTestConfig(upstreamServer.URL)
+			cfg.Batching = config.BatchOptions{Enabled: true, Mode: test.mode, MaxSize: 3}
+			router := newTestRouter(t, cfg)
+
+			var items []map[string]string
+			for _, query := range test.queries {
+				items = append(items, map[string]string{"query": query})
+			}
+			body, _ := json.Marshal(items)
+			recorder := serve(router, newPostRequest(string(body), "reader"))
+
+			if recorder.Code != test.status {
+				t.Fatalf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body.String())
+			}
+			if test.upstream == nil && len(*batches) > 0 {
+				t.Fatalf("Expected nothing to be forwarded, got %v", *batches)
+			}
+			if test.upstream != nil && (len(*batches) != 1 || strings.Join((*batches)[0], "|") != strings.Join(test.upstream, "|")) {
+				t.Fatalf("Expected %v to be forwarded, got %v", test.upstream, *batches)
+			}
+			if test.denied == nil {
+				return
+			}
+
+			var responses []struct {
+				Data   map[string]string `json:"data"`
+				Errors []graphqlError    `json:"errors"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &responses); err != nil || len(responses) != len(test.queries) {
+				t.Fatalf("Expected %d responses, got %s", len(test.queries), recorder.Body.String())
+			}
+			for i, response := range responses {
+				if denied := len(response.Errors) > 0; denied != test.denied[i] {
+					t.Fatalf("Expected response %d to be denied: %v, got %+v", i, test.denied[i], response)
+				}
+				if !test.denied[i] && response.Data["query"] != test.queries[i] {
+					t.Fatalf("Expected response %d to answer %s, got %+v", i, test.queries[i], response)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyProxy_BatchDisabled(t *testing.T) {
+	upstreamServer, batches := newBatchUpstream(t, 0)
+	router := newTestRouter(t, newTestConfig(upstreamServer.URL))
+
+	recorder := serve(router, newPostRequest(`[{"query":"{ public { news } }"}]`, "reader"))
+
+	if recorder.Code != http.StatusBadRequest || len(*batches) > 0 {
+		t.Fatalf("Expected the batch to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
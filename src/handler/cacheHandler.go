@@ -3,8 +3,11 @@ package handler
 import (
 	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"github.com/graphql-iam/agent/src/repository"
+	"github.com/graphql-iam/agent/src/service"
 	"github.com/patrickmn/go-cache"
 	"net/http"
+	"strings"
 )
 
 type CacheHandler struct {
@@ -16,7 +19,8 @@ func NewCacheHandler(cache *cache.Cache) *CacheHandler {
 }
 
 type invalidateRequestBody struct {
-	Role string `json:"role"`
+	Role      string `json:"role"`
+	Namespace string `json:"namespace"`
 }
 
 // TODO Auth
@@ -28,7 +32,13 @@ func (c *CacheHandler) Invalidate(context *gin.Context) {
 		context.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	c.cache.Delete(body.Role)
+	c.cache.Delete(repository.RoleCacheKey(body.Namespace, body.Role))
+	// cached decisions may depend on the role
+	for key := range c.cache.Items() {
+		if strings.HasPrefix(key, service.DecisionCachePrefix) {
+			c.cache.Delete(key)
+		}
+	}
 	context.Status(http.StatusOK)
 }
 
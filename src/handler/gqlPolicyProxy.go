@@ -3,143 +3,419 @@ package handler
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/graphql-iam/agent/src/auth"
 	"github.com/graphql-iam/agent/src/config"
 	"github.com/graphql-iam/agent/src/service"
+	"github.com/graphql-iam/agent/src/upstream"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
-	"time"
 )
 
 type PolicyProxy struct {
-	cfg         config.Config
-	jwtService  *service.JwtService
-	authService *service.AuthService
+	cfg                   config.Config
+	roleResolver          roleResolver
+	authService           *service.AuthService
+	schemaService         *service.SchemaService
+	persistedQueryService *service.PersistedQueryService
+	upstreamClient        *upstream.Client
 }
 
-func NewPolicyProxy(cfg config.Config, jwtService *service.JwtService, authService *service.AuthService) PolicyProxy {
+func NewPolicyProxy(cfg config.Config, jwtService *service.JwtService, authService *service.AuthService, schemaService *service.SchemaService, persistedQueryService *service.PersistedQueryService, upstreamClient *upstream.Client) PolicyProxy {
 	return PolicyProxy{
-		cfg:         cfg,
-		jwtService:  jwtService,
-		authService: authService,
+		cfg:                   cfg,
+		roleResolver:          roleResolver{jwtService: jwtService},
+		authService:           authService,
+		schemaService:         schemaService,
+		persistedQueryService: persistedQueryService,
+		upstreamClient:        upstreamClient,
 	}
 }
 
+// policyProxyPostData is a GraphQL request, queryHash is set once its persisted query is resolved.
 type policyProxyPostData struct {
-	Query     string                 `json:"query"`
-	Operation string                 `json:"operationName"`
-	Variables map[string]interface{} `json:"variables"`
+	Query      string                 `json:"query"`
+	Operation  string                 `json:"operationName"`
+	Variables  map[string]interface{} `json:"variables"`
+	Extensions requestExtensions      `json:"extensions"`
+	queryHash  string
 }
 
+// Handler authorizes and forwards GraphQL requests sent as POST with a JSON body
+// or as GET with the request in the query string.
 func (p *PolicyProxy) Handler(context *gin.Context) {
-	jsonBytes, err := io.ReadAll(context.Request.Body)
-	if err != nil {
-		panic(err)
+	route, ok := matchRoute(p.cfg.Routes, context)
+	if !ok {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusNotFound, newGraphqlError("No route matches the request", codeNotFound))
+		return
 	}
 
+	var jsonBytes []byte
 	var data policyProxyPostData
-	err = json.Unmarshal(jsonBytes, &data)
+	var err error
+	if context.Request.Method == http.MethodGet {
+		data, err = parseGetData(context.Request.URL.Query())
+	} else {
+		jsonBytes, err = io.ReadAll(context.Request.Body)
+		if err != nil {
+			panic(err)
+		}
+		if isBatch(jsonBytes) {
+			p.batchHandler(context, route, jsonBytes)
+			return
+		}
+		err = json.Unmarshal(jsonBytes, &data)
+	}
 	if err != nil {
 		fmt.Println(err.Error())
-		context.AbortWithStatus(http.StatusBadRequest)
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadRequest, newGraphqlError("Request is not a valid GraphQL request", codeBadRequest))
+		return
+	}
+
+	jsonBytes, status, gqlErr := p.withPersistedQuery(context, &data, jsonBytes)
+	if gqlErr != nil {
+		abortWithGraphqlErrors(context, p.cfg, status, *gqlErr)
 		return
 	}
 
-	rolesStr, err := p.resolveRoles(context)
+	rolesStr, claims, err := p.roleResolver.resolveRoles(context.Request.Context(), route.Auth, context.Request.Header)
 	if err != nil {
 		fmt.Printf("Error resolving roles: %v\n", err.Error())
-		context.AbortWithStatus(http.StatusBadRequest)
+		abortWithGraphqlErrors(context, p.cfg, http.StatusUnauthorized, newGraphqlError("Could not authenticate request", codeUnauthenticated))
 		return
 	}
 
-	authorized, err := p.authService.AuthorizeWithRoles(rolesStr, *context.Request, data.Variables, data.Query)
+	if gqlErrors := p.validate(route, data); len(gqlErrors) > 0 {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadRequest, gqlErrors...)
+		return
+	}
+
+	authRequest := p.newAuthRequest(context, route, rolesStr, claims, data)
+	decision, err := p.authService.AuthorizeWithRoles(authRequest)
 	if err != nil {
 		log.Printf("request was denied with error: %v\n", err)
-		context.AbortWithStatus(http.StatusUnauthorized)
+		abortWithGraphqlErrors(context, p.cfg, http.StatusInternalServerError, newGraphqlError("Could not authorize request", codeInternalError))
+		return
+	}
+
+	if decision.Introspection && p.cfg.Introspection.Block {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusForbidden, newIntrospectionDisabledError())
+		return
+	}
+
+	if context.Request.Method == http.MethodGet && decision.Action == "mutation" {
+		// GraphQL over HTTP requires mutations over GET to be answered with 405 regardless of the status mode
+		context.Header("Allow", http.MethodPost)
+		context.AbortWithStatusJSON(http.StatusMethodNotAllowed, graphqlErrorResponse{
+			Errors: []graphqlError{newGraphqlError("Mutations can only be sent with POST", codeBadRequest)},
+		})
 		return
 	}
 
-	if !authorized {
-		log.Println("Request was denied")
-		context.AbortWithStatus(http.StatusBadRequest)
+	rewrite := p.introspectionRewrite(authRequest, decision)
+	if decision.Allowed {
+		p.proxyRequest(context, route, jsonBytes, decision.Action, rewrite)
 		return
 	}
 
-	p.proxyRequest(context, jsonBytes)
+	log.Printf("Request was denied: %s\n", strings.Join(decision.Reasons(), "; "))
+	if route.DenyMode == config.DenyModeStrip && decision.Error == "" {
+		p.proxyStrippedRequest(context, route, jsonBytes, data, decision, rewrite)
+		return
+	}
+	p.abortDenied(context, decision)
 }
 
-func (p *PolicyProxy) proxyRequest(context *gin.Context, data []byte) {
-	proxyRequest, err := http.NewRequest("POST", p.cfg.SourceUrl, bytes.NewBuffer(data))
+// proxyStrippedRequest forwards the request without the denied fields. The request is
+// rejected as a whole if nothing would be left to forward.
+func (p *PolicyProxy) proxyStrippedRequest(context *gin.Context, route config.Route, jsonBytes []byte, data policyProxyPostData, decision auth.Decision, rewrite responseRewrite) {
+	query, stripped, err := auth.StripDenied(data.Query, data.Operation, decision)
+	if err != nil || len(stripped) == 0 {
+		p.abortDenied(context, decision)
+		return
+	}
+	rewrite = chainRewrites(strippedFieldsRewrite(stripped), rewrite)
+
+	if context.Request.Method == http.MethodGet {
+		values := context.Request.URL.Query()
+		values.Set("query", query)
+		if extensions := values.Get("extensions"); extensions != "" {
+			stripped, err := withoutPersistedQuery([]byte(extensions))
+			if err != nil {
+				abortWithGraphqlErrors(context, p.cfg, http.StatusInternalServerError, newGraphqlError("Failed to create request", codeInternalError))
+				return
+			}
+			values.Set("extensions", string(stripped))
+		}
+		context.Request.URL.RawQuery = values.Encode()
+		p.proxyRequest(context, route, nil, decision.Action, rewrite)
+		return
+	}
+
+	body, err := replaceStrippedQuery(jsonBytes, query)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		abortWithGraphqlErrors(context, p.cfg, http.StatusInternalServerError, newGraphqlError("Failed to create request", codeInternalError))
 		return
 	}
+	p.proxyRequest(context, route, body, decision.Action, rewrite)
+}
 
-	for name, values := range context.Request.Header {
-		for _, value := range values {
-			proxyRequest.Header.Add(name, value)
+// withPersistedQuery resolves the persisted query of the request. The returned body carries the
+// query if the client only sent its hash, GET requests get it added to their query string.
+func (p *PolicyProxy) withPersistedQuery(context *gin.Context, data *policyProxyPostData, jsonBytes []byte) ([]byte, int, *graphqlError) {
+	query, hash, status, gqlErr := resolvePersistedQuery(p.persistedQueryService, data.Query, data.Extensions)
+	if gqlErr != nil {
+		return nil, status, gqlErr
+	}
+	data.queryHash = hash
+	if query == data.Query {
+		return jsonBytes, 0, nil
+	}
+
+	data.Query = query
+	if context.Request.Method == http.MethodGet {
+		values := context.Request.URL.Query()
+		values.Set("query", query)
+		context.Request.URL.RawQuery = values.Encode()
+		return nil, 0, nil
+	}
+	body, err := replaceQuery(jsonBytes, query)
+	if err != nil {
+		gqlErr := newGraphqlError("Failed to create request", codeInternalError)
+		return nil, http.StatusInternalServerError, &gqlErr
+	}
+	return body, 0, nil
+}
+
+func (p *PolicyProxy) newAuthRequest(context *gin.Context, route config.Route, rolesStr []string, claims map[string]interface{}, data policyProxyPostData) service.AuthRequest {
+	return service.AuthRequest{
+		Route:         route.Name,
+		Namespace:     route.PolicyNamespace,
+		Roles:         rolesStr,
+		Claims:        claims,
+		Request:       *context.Request,
+		Variables:     data.Variables,
+		Query:         data.Query,
+		OperationName: data.Operation,
+		Schema:        p.schemaService.Schema(route.Name),
+		QueryHash:     data.queryHash,
+	}
+}
+
+// validate returns the validation errors of the request if the route validates against its schema.
+func (p *PolicyProxy) validate(route config.Route, data policyProxyPostData) []graphqlError {
+	return validateRequest(p.schemaService, route, data.Query, data.Operation, data.Variables)
+}
+
+func validateRequest(schemaService *service.SchemaService, route config.Route, query string, operationName string, variables map[string]interface{}) []graphqlError {
+	schema := schemaService.Schema(route.Name)
+	if !route.Schema.Validate || schema == nil {
+		return nil
+	}
+	return newValidationErrors(auth.ValidateRequest(query, operationName, variables, schema))
+}
+
+func parseGetData(values url.Values) (policyProxyPostData, error) {
+	data := policyProxyPostData{
+		Query:     values.Get("query"),
+		Operation: values.Get("operationName"),
+	}
+	if variables := values.Get("variables"); variables != "" {
+		err := json.Unmarshal([]byte(variables), &data.Variables)
+		if err != nil {
+			return data, err
 		}
 	}
+	if extensions := values.Get("extensions"); extensions != "" {
+		err := json.Unmarshal([]byte(extensions), &data.Extensions)
+		if err != nil {
+			return data, err
+		}
+	}
+	if data.Query == "" && data.Extensions.PersistedQuery == nil {
+		return data, errors.New("no query provided in query string")
+	}
+	return data, nil
+}
 
-	proxyRequest.Header.Add("X-Forwarded-For", context.ClientIP())
-	proxyRequest.Header.Add("X-Forwarded-Proto", context.Request.Proto)
+func replaceQuery(jsonBytes []byte, query string) ([]byte, error) {
+	var body map[string]json.RawMessage
+	err := json.Unmarshal(jsonBytes, &body)
+	if err != nil {
+		return nil, err
+	}
+	body["query"], err = json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(body)
+}
 
-	proxyClient := &http.Client{
-		Timeout: 10 * time.Second,
+// replaceStrippedQuery replaces the query of the body with its stripped version. The persisted
+// query extension is dropped since its hash no longer matches the query.
+func replaceStrippedQuery(jsonBytes []byte, query string) ([]byte, error) {
+	var body map[string]json.RawMessage
+	err := json.Unmarshal(jsonBytes, &body)
+	if err != nil {
+		return nil, err
+	}
+	body["query"], err = json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	if extensions, ok := body["extensions"]; ok {
+		body["extensions"], err = withoutPersistedQuery(extensions)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return json.Marshal(body)
+}
 
-	proxyResponse, err := proxyClient.Do(proxyRequest)
+// withoutPersistedQuery removes the persisted query extension, whose key is matched ignoring case
+// like when the request is parsed.
+func withoutPersistedQuery(extensions []byte) ([]byte, error) {
+	var values map[string]json.RawMessage
+	err := json.Unmarshal(extensions, &values)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to proxy request"})
+		return nil, err
+	}
+	for key := range values {
+		if strings.EqualFold(key, "persistedQuery") {
+			delete(values, key)
+		}
+	}
+	return json.Marshal(values)
+}
+
+// responseRewrite changes the buffered JSON body of an upstream response.
+type responseRewrite func(body []byte) ([]byte, error)
+
+// chainRewrites applies the given rewrites in order, nil ones are skipped.
+func chainRewrites(rewrites ...responseRewrite) responseRewrite {
+	var chain []responseRewrite
+	for _, rewrite := range rewrites {
+		if rewrite != nil {
+			chain = append(chain, rewrite)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return func(body []byte) ([]byte, error) {
+		var err error
+		for _, rewrite := range chain {
+			body, err = rewrite(body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return body, nil
+	}
+}
+
+func strippedFieldsRewrite(stripped []auth.StrippedField) responseRewrite {
+	return func(body []byte) ([]byte, error) {
+		return addStrippedFieldErrors(body, stripped)
+	}
+}
+
+// introspectionRewrite filters introspection results down to what the caller may see if configured.
+func (p *PolicyProxy) introspectionRewrite(authRequest service.AuthRequest, decision auth.Decision) responseRewrite {
+	return introspectionRewrite(p.cfg, p.authService, authRequest, decision)
+}
+
+func introspectionRewrite(cfg config.Config, authService *service.AuthService, authRequest service.AuthRequest, decision auth.Decision) responseRewrite {
+	if !decision.Introspection || !cfg.Introspection.Filter {
+		return nil
+	}
+	return func(body []byte) ([]byte, error) {
+		return authService.FilterIntrospection(authRequest, decision, body)
+	}
+}
+
+func (p *PolicyProxy) abortDenied(context *gin.Context, decision auth.Decision) {
+	status, gqlErr := newDeniedError(p.cfg, decision)
+	abortWithGraphqlErrors(context, p.cfg, status, gqlErr)
+}
+
+// proxyRequest streams the upstream response to the client. If a rewrite is given the response is
+// requested as JSON and buffered to apply it, any other response is answered with an error instead.
+func (p *PolicyProxy) proxyRequest(context *gin.Context, route config.Route, data []byte, action string, rewrite responseRewrite) {
+	proxyResponse, err := p.sendUpstream(context, route, data, action == "query", rewrite != nil)
+	if err != nil {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to proxy request", codeInternalError))
 		return
 	}
 	defer proxyResponse.Body.Close()
 
+	if rewrite == nil {
+		err = streamResponse(context, proxyResponse)
+		if err != nil {
+			log.Printf("failed to stream response: %v\n", err)
+		}
+		return
+	}
+	if !isJsonResponse(proxyResponse.Header.Get("Content-Type")) {
+		log.Printf("can't rewrite upstream response of type %s\n", proxyResponse.Header.Get("Content-Type"))
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to read response", codeInternalError))
+		return
+	}
+
 	proxyResponseBody, err := io.ReadAll(proxyResponse.Body)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to read response", codeInternalError))
 		return
 	}
 
+	proxyResponseBody, err = rewrite(proxyResponseBody)
+	if err != nil {
+		abortWithGraphqlErrors(context, p.cfg, http.StatusBadGateway, newGraphqlError("Failed to read response", codeInternalError))
+		return
+	}
+
+	copyHeaders(context.Writer.Header(), proxyResponse.Header, "Content-Length")
 	context.Data(proxyResponse.StatusCode, proxyResponse.Header.Get("Content-Type"), proxyResponseBody)
 }
 
-func (p *PolicyProxy) resolveRoles(context *gin.Context) ([]string, error) {
-	switch p.cfg.Auth.Mode {
-	case "jwt":
-		return p.resolveRolesFromJwt(context)
-	case "header":
-		return p.resolveRolesFromHeader(context)
+// sendUpstream forwards the request upstream with the same method, POST requests with data
+// as body and GET requests with their query string. Cancelling the incoming request cancels
+// the upstream request, connection errors are only retried if retryable is set. Responses that are
+// buffered to be parsed are requested as JSON without the encodings of the client, so they arrive decoded.
+func (p *PolicyProxy) sendUpstream(context *gin.Context, route config.Route, data []byte, retryable bool, buffered bool) (*http.Response, error) {
+	ctx := context.Request.Context()
+	var proxyRequest *http.Request
+	var err error
+	if context.Request.Method == http.MethodGet {
+		proxyRequest, err = http.NewRequestWithContext(ctx, http.MethodGet, withRawQuery(route.SourceUrl, context.Request.URL.RawQuery), nil)
+	} else {
+		proxyRequest, err = http.NewRequestWithContext(ctx, http.MethodPost, route.SourceUrl, bytes.NewReader(data))
 	}
-	return nil, fmt.Errorf("mode %s is not p valid auth mode", p.cfg.Auth.Mode)
-}
-
-func (p *PolicyProxy) resolveRolesFromJwt(context *gin.Context) ([]string, error) {
-	token, err := p.jwtService.Parse(context.GetHeader("Authorization"))
 	if err != nil {
 		return nil, err
 	}
 
-	rolesInterface, exists := token.Get(p.cfg.Auth.JwtOptions.RoleClaim)
-	if !exists {
-		return nil, err
+	if buffered {
+		copyHeaders(proxyRequest.Header, context.Request.Header, "Accept", "Accept-Encoding")
+		proxyRequest.Header.Set("Accept", strings.Join(graphqlResponseMediaTypes, ", "))
+	} else {
+		copyHeaders(proxyRequest.Header, context.Request.Header)
 	}
 
-	rolesString, ok := rolesInterface.(string)
-	if !ok {
-		return nil, err
-	}
+	proxyRequest.Header.Add("X-Forwarded-For", context.ClientIP())
+	proxyRequest.Header.Add("X-Forwarded-Proto", context.Request.Proto)
 
-	return strings.Split(rolesString, ","), nil
+	return p.upstreamClient.Do(proxyRequest, retryable)
 }
 
-func (p *PolicyProxy) resolveRolesFromHeader(context *gin.Context) ([]string, error) {
-	headerVal := context.GetHeader(p.cfg.Auth.HeaderOptions.Name)
-	if headerVal == "" {
-		return nil, fmt.Errorf("header %s has no value", p.cfg.Auth.HeaderOptions.Name)
+func withRawQuery(sourceUrl string, rawQuery string) string {
+	if strings.Contains(sourceUrl, "?") {
+		return sourceUrl + "&" + rawQuery
 	}
-	return strings.Split(headerVal, ","), nil
+	return sourceUrl + "?" + rawQuery
 }
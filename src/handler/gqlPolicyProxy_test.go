@@ -0,0 +1,406 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/model"
+	"github.com/graphql-iam/agent/src/repository"
+	"github.com/graphql-iam/agent/src/service"
+	"github.com/graphql-iam/agent/src/upstream"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testRoles are the roles the test proxies know, reader may query and subscribe to everything but accounts.
+var testRoles = []model.Role{
+	{
+		Name: "reader",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "reader",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowQueries",
+						Action:   model.Patterns{"query", "subscription"},
+						Effect:   "allow",
+						Resource: model.Patterns{"**"},
+					},
+					{
+						Sid:      "denyAccounts",
+						Action:   model.Patterns{"query", "subscription"},
+						Effect:   "deny",
+						Resource: model.Patterns{"account.**"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name: "admin",
+		Policies: []model.Policy{
+			{
+				ID:      "2",
+				Name:    "admin",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowAll",
+						Action:   model.Patterns{"*"},
+						Effect:   "allow",
+						Resource: model.Patterns{"**"},
+					},
+				},
+			},
+		},
+	},
+}
+
+// newTestConfig returns a config with a single route to the upstream, authenticated by the X-Roles header.
+func newTestConfig(upstreamUrl string) config.Config {
+	return config.Config{
+		ErrorOptions: config.ErrorOptions{StatusMode: config.StatusModeHttp},
+		Routes: []config.Route{{
+			Name:            "default",
+			Path:            "/graphql",
+			SourceUrl:       upstreamUrl,
+			SubscriptionUrl: "ws" + strings.TrimPrefix(upstreamUrl, "http"),
+			DenyMode:        config.DenyModeReject,
+			Auth: config.AuthOptions{
+				Mode:          "header",
+				HeaderOptions: config.HeaderOptions{Name: "X-Roles"},
+			},
+		}},
+	}
+}
+
+// newTestRouter registers the proxies on the paths of the routes like the server does.
+func newTestRouter(t *testing.T, cfg config.Config) *gin.Engine {
+	c := cache.New(cache.NoExpiration, 0)
+	for _, role := range testRoles {
+		c.Set(repository.RoleCacheKey("", role.Name), role, cache.NoExpiration)
+	}
+
+	upstreamClient, err := upstream.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authService, err := service.NewAuthService(cfg, repository.NewRolesRepository(cfg, c, http.Client{}), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaService, err := service.NewSchemaService(cfg, upstreamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistedQueryService, err := service.NewPersistedQueryService(cfg, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtService := service.NewJwtService(cfg)
+	policyProxy := NewPolicyProxy(cfg, jwtService, authService, schemaService, persistedQueryService, upstreamClient)
+	subscriptionProxy := NewSubscriptionProxy(cfg, jwtService, authService, schemaService, persistedQueryService, upstreamClient)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	registered := make(map[string]bool)
+	for _, route := range cfg.Routes {
+		if registered[route.Path] {
+			continue
+		}
+		registered[route.Path] = true
+		router.POST(route.Path, policyProxy.Handler)
+		router.GET(route.Path, func(context *gin.Context) {
+			if cfg.Subscriptions.Enabled && websocket.IsWebSocketUpgrade(context.Request) {
+				subscriptionProxy.Handler(context)
+				return
+			}
+			policyProxy.Handler(context)
+		})
+	}
+	return router
+}
+
+// serve sends the request to the router and returns the recorded response.
+func serve(router *gin.Engine, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newPostRequest(body string, roles string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if roles != "" {
+		request.Header.Set("X-Roles", roles)
+	}
+	return request
+}
+
+func decodeErrors(t *testing.T, recorder *httptest.ResponseRecorder) []graphqlError {
+	var response graphqlErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a GraphQL response, got %s", recorder.Body.String())
+	}
+	return response.Errors
+}
+
+func TestPolicyProxy_RewrittenResponseTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		rewritten   bool
+	}{
+		{"json", "application/json; charset=utf-8", http.StatusOK, true},
+		{"graphql response", "application/graphql-response+json", http.StatusOK, true},
+		{"multipart", "multipart/mixed; boundary=\"-\"", http.StatusBadGateway, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var upstreamRequest *http.Request
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamRequest = r
+				w.Header().Set("Content-Type", test.contentType)
+				_, _ = w.Write([]byte(`{"data":{"public":{"news":"hello"}}}`))
+			}))
+			defer upstreamServer.Close()
+
+			cfg := newTestConfig(upstreamServer.URL)
+			cfg.Routes[0].DenyMode = config.DenyModeStrip
+			router := newTestRouter(t, cfg)
+
+			request := newPostRequest(`{"query":"{ public { news } account { email } }"}`, "reader")
+			request.Header.Set("Accept", "multipart/mixed, application/graphql-response+json")
+			recorder := serve(router, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body.String())
+			}
+			if accept := upstreamRequest.Header.Get("Accept"); accept != "application/graphql-response+json, application/json" {
+				t.Fatalf("Expected the upstream to be asked for JSON, got %q", accept)
+			}
+			errs := decodeErrors(t, recorder)
+			if rewritten := len(errs) == 1 && strings.Contains(errs[0].Message, "account"); rewritten != test.rewritten {
+				t.Fatalf("Expected the response to be rewritten: %v, got %s", test.rewritten, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestPolicyProxy_StrippedPersistedQuery(t *testing.T) {
+	query := "{ public { news } account { email } }"
+	hash := service.HashQuery(query)
+	extensions := `{"persistedQuery":{"version":1,"sha256Hash":"` + hash + `"},"tracing":true}`
+
+	var upstreamQuery string
+	var upstreamExtensions map[string]interface{}
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Query      string                 `json:"query"`
+			Extensions map[string]interface{} `json:"extensions"`
+		}
+		if r.Method == http.MethodGet {
+			data.Query = r.URL.Query().Get("query")
+			_ = json.Unmarshal([]byte(r.URL.Query().Get("extensions")), &data.Extensions)
+		} else {
+			_ = json.NewDecoder(r.Body).Decode(&data)
+		}
+		upstreamQuery, upstreamExtensions = data.Query, data.Extensions
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"public":{"news":"hello"}}}`))
+	}))
+	defer upstreamServer.Close()
+
+	cfg := newTestConfig(upstreamServer.URL)
+	cfg.Routes[0].DenyMode = config.DenyModeStrip
+	cfg.PersistedQueries.Enabled = true
+	router := newTestRouter(t, cfg)
+
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "extensions": json.RawMessage(extensions)})
+	values := url.Values{"query": {query}, "extensions": {extensions}}
+	requests := map[string]*http.Request{
+		"post": newPostRequest(string(body), "reader"),
+		"get":  httptest.NewRequest(http.MethodGet, "/graphql?"+values.Encode(), nil),
+	}
+	requests["get"].Header.Set("X-Roles", "reader")
+
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			recorder := serve(router, request)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			if strings.Contains(upstreamQuery, "account") {
+				t.Fatalf("Expected the account to be stripped, got %q", upstreamQuery)
+			}
+			if _, ok := upstreamExtensions["persistedQuery"]; ok || upstreamExtensions["tracing"] != true {
+				t.Fatalf("Expected only the persisted query extension to be dropped, got %v", upstreamExtensions)
+			}
+		})
+	}
+}
+
+// recordingUpstream answers every request with body as JSON and records the last request.
+type recordingUpstream struct {
+	*httptest.Server
+	requests int
+	request  *http.Request
+	body     []byte
+}
+
+func newRecordingUpstream(t *testing.T, body string) *recordingUpstream {
+	u := &recordingUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.requests++
+		u.request = r
+		u.body, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func TestPolicyProxy_StatusModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusMode string
+		roles      string
+		query      string
+		status     int
+		code       string
+	}{
+		{"denied", config.StatusModeHttp, "reader", "{ account { email } }", http.StatusForbidden, codeForbidden},
+		{"denied with ok status", config.StatusModeOk, "reader", "{ account { email } }", http.StatusOK, codeForbidden},
+		{"unauthenticated", config.StatusModeHttp, "", "{ public { news } }", http.StatusUnauthorized, codeUnauthenticated},
+		{"unauthenticated with ok status", config.StatusModeOk, "", "{ public { news } }", http.StatusOK, codeUnauthenticated},
+		{"invalid query", config.StatusModeHttp, "reader", "{ public { news }", http.StatusBadRequest, codeBadRequest},
+		{"invalid query with ok status", config.StatusModeOk, "reader", "{ public { news }", http.StatusOK, codeBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamServer := newRecordingUpstream(t, `{"data":{}}`)
+			cfg := newTestConfig(upstreamServer.URL)
+			cfg.ErrorOptions.StatusMode = test.statusMode
+			router := newTestRouter(t, cfg)
+
+			body, _ := json.Marshal(map[string]string{"query": test.query})
+			recorder := serve(router, newPostRequest(string(body), test.roles))
+
+			if recorder.Code != test.status {
+				t.Fatalf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body.String())
+			}
+			errs := decodeErrors(t, recorder)
+			if len(errs) != 1 || errs[0].Extensions["code"] != test.code {
+				t.Fatalf("Expected an error with code %s, got %s", test.code, recorder.Body.String())
+			}
+			if upstreamServer.requests != 0 {
+				t.Fatal("Expected the request not to be forwarded")
+			}
+		})
+	}
+}
+
+func TestPolicyProxy_GetRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    url.Values
+		roles     string
+		status    int
+		forwarded bool
+	}{
+		{
+			name:      "query",
+			values:    url.Values{"query": {"query News($id: ID) { public(id: $id) { news } }"}, "operationName": {"News"}, "variables": {`{"id":"1"}`}},
+			roles:     "reader",
+			status:    http.StatusOK,
+			forwarded: true,
+		},
+		{
+			name:   "denied query",
+			values: url.Values{"query": {"{ account { email } }"}},
+			roles:  "reader",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "mutation",
+			values: url.Values{"query": {"mutation { deleteUser(id: 1) { id } }"}},
+			roles:  "admin",
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "malformed variables",
+			values: url.Values{"query": {"{ public { news } }"}, "variables": {`{"id":`}},
+			roles:  "reader",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing query",
+			values: url.Values{"operationName": {"News"}},
+			roles:  "reader",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamServer := newRecordingUpstream(t, `{"data":{"public":{"news":"hello"}}}`)
+			router := newTestRouter(t, newTestConfig(upstreamServer.URL))
+
+			request := httptest.NewRequest(http.MethodGet, "/graphql?"+test.values.Encode(), nil)
+			request.Header.Set("X-Roles", test.roles)
+			recorder := serve(router, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body.String())
+			}
+			if test.status == http.StatusMethodNotAllowed && recorder.Header().Get("Allow") != http.MethodPost {
+				t.Fatalf("Expected POST to be allowed, got %q", recorder.Header().Get("Allow"))
+			}
+			if forwarded := upstreamServer.requests == 1; forwarded != test.forwarded {
+				t.Fatalf("Expected the request to be forwarded: %v, got %v", test.forwarded, forwarded)
+			}
+			if test.forwarded && (upstreamServer.request.Method != http.MethodGet || upstreamServer.request.URL.Query().Get("variables") != `{"id":"1"}`) {
+				t.Fatalf("Expected the query string to be forwarded with GET, got %s %s", upstreamServer.request.Method, upstreamServer.request.URL)
+			}
+		})
+	}
+}
+
+func TestPolicyProxy_HopByHopHeaders(t *testing.T) {
+	upstreamServer := newRecordingUpstream(t, `{"data":{"public":{"news":"hello"}}}`)
+	router := newTestRouter(t, newTestConfig(upstreamServer.URL))
+
+	request := newPostRequest(`{"query":"{ public { news } }"}`, "reader")
+	request.Header.Set("Connection", "X-Secret")
+	request.Header.Set("X-Secret", "secret")
+	request.Header.Set("Keep-Alive", "timeout=5")
+	request.Header.Set("Te", "trailers")
+	request.Header.Set("X-Request-Id", "1")
+	recorder := serve(router, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	for _, name := range []string{"X-Secret", "Keep-Alive", "Te"} {
+		if value := upstreamServer.request.Header.Get(name); value != "" {
+			t.Fatalf("Expected header %s not to be forwarded, got %q", name, value)
+		}
+	}
+	if upstreamServer.request.Header.Get("X-Request-Id") != "1" {
+		t.Fatalf("Expected end-to-end headers to be forwarded, got %v", upstreamServer.request.Header)
+	}
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/location"
+	"github.com/graphql-iam/agent/src/auth"
+	"github.com/graphql-iam/agent/src/config"
+	"net/http"
+)
+
+const (
+	codeBadRequest      = "BAD_REQUEST"
+	codeUnauthenticated = "UNAUTHENTICATED"
+	codeForbidden       = "FORBIDDEN"
+	codeNotFound        = "NOT_FOUND"
+	codeInternalError   = "INTERNAL_SERVER_ERROR"
+	codeValidation      = "GRAPHQL_VALIDATION_FAILED"
+)
+
+type graphqlError struct {
+	Message    string                    `json:"message"`
+	Locations  []location.SourceLocation `json:"locations,omitempty"`
+	Path       []interface{}             `json:"path,omitempty"`
+	Extensions map[string]interface{}    `json:"extensions,omitempty"`
+}
+
+type graphqlErrorResponse struct {
+	Errors []graphqlError `json:"errors"`
+}
+
+func newGraphqlError(message string, code string) graphqlError {
+	return graphqlError{
+		Message:    message,
+		Extensions: map[string]interface{}{"code": code},
+	}
+}
+
+func newValidationErrors(errs []gqlerrors.FormattedError) []graphqlError {
+	gqlErrors := make([]graphqlError, len(errs))
+	for i, err := range errs {
+		gqlErrors[i] = newGraphqlError(err.Message, codeValidation)
+		gqlErrors[i].Locations = err.Locations
+	}
+	return gqlErrors
+}
+
+func newIntrospectionDisabledError() graphqlError {
+	return newGraphqlError("Introspection is disabled", codeForbidden)
+}
+
+// abortWithGraphqlErrors ends the request with a GraphQL response carrying only errors.
+// The status is replaced by 200 if the config asks for GraphQL style status codes.
+func abortWithGraphqlErrors(context *gin.Context, cfg config.Config, status int, errors ...graphqlError) {
+	if cfg.ErrorOptions.StatusMode == config.StatusModeOk {
+		status = http.StatusOK
+	}
+	context.AbortWithStatusJSON(status, graphqlErrorResponse{Errors: errors})
+}
+
+// newDeniedError describes a denied decision, the decision itself is only included in debug mode.
+func newDeniedError(cfg config.Config, decision auth.Decision) (int, graphqlError) {
+	if decision.Error != "" {
+		gqlErr := newGraphqlError(decision.Error, codeBadRequest)
+		if cfg.Debug {
+			gqlErr.Extensions["decision"] = decision
+		}
+		return http.StatusBadRequest, gqlErr
+	}
+
+	gqlErr := newGraphqlError(fmt.Sprintf("Not authorized to access the requested fields of this %s", decision.Action), codeForbidden)
+	gqlErr.Extensions["deniedFields"] = decision.DeniedResources()
+	if cfg.Debug {
+		gqlErr.Extensions["decision"] = decision
+	}
+	return http.StatusForbidden, gqlErr
+}
+
+// addStrippedFieldErrors sets the fields removed from the request to null in the upstream response
+// and adds an error for every occurrence, the same way a failing resolver would be reported.
+func addStrippedFieldErrors(body []byte, stripped []auth.StrippedField) ([]byte, error) {
+	var response map[string]interface{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	errors, _ := response["errors"].([]interface{})
+	for _, field := range stripped {
+		paths := nullField(response["data"], field.Path, nil)
+		if len(paths) == 0 {
+			paths = [][]interface{}{stringsToPath(field.Path)}
+		}
+		for _, path := range paths {
+			gqlErr := newGraphqlError(fmt.Sprintf("Not authorized to access %s", field.Resource), codeForbidden)
+			gqlErr.Path = path
+			errors = append(errors, gqlErr)
+		}
+	}
+	response["errors"] = errors
+
+	return json.Marshal(response)
+}
+
+// nullField sets the field at keys to null, descending into every element of lists on the way.
+// It returns the concrete response paths of all fields that were set.
+func nullField(value interface{}, keys []string, path []interface{}) [][]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		fieldPath := append(append([]interface{}{}, path...), keys[0])
+		if len(keys) == 1 {
+			v[keys[0]] = nil
+			return [][]interface{}{fieldPath}
+		}
+		return nullField(v[keys[0]], keys[1:], fieldPath)
+	case []interface{}:
+		var paths [][]interface{}
+		for i, item := range v {
+			paths = append(paths, nullField(item, keys, append(append([]interface{}{}, path...), i))...)
+		}
+		return paths
+	}
+	return nil
+}
+
+func stringsToPath(keys []string) []interface{} {
+	path := make([]interface{}, len(keys))
+	for i, key := range keys {
+		path[i] = key
+	}
+	return path
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"errors"
+	"github.com/graphql-iam/agent/src/service"
+	"net/http"
+)
+
+const (
+	codePersistedQueryNotFound     = "PERSISTED_QUERY_NOT_FOUND"
+	codePersistedQueryNotSupported = "PERSISTED_QUERY_NOT_SUPPORTED"
+)
+
+type requestExtensions struct {
+	PersistedQuery *persistedQuery `json:"persistedQuery,omitempty"`
+}
+
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+func (e requestExtensions) persistedQueryHash() string {
+	if e.PersistedQuery == nil {
+		return ""
+	}
+	return e.PersistedQuery.Sha256Hash
+}
+
+// resolvePersistedQuery returns the query of the request and its persisted query hash. If the
+// query can't be resolved or isn't allowed the error and status to answer the request with are returned.
+func resolvePersistedQuery(persistedQueryService *service.PersistedQueryService, query string, extensions requestExtensions) (string, string, int, *graphqlError) {
+	query, hash, err := persistedQueryService.Resolve(query, extensions.persistedQueryHash())
+	if err == nil {
+		return query, hash, 0, nil
+	}
+
+	var status int
+	var gqlErr graphqlError
+	switch {
+	case errors.Is(err, service.ErrPersistedQueryNotFound):
+		status, gqlErr = http.StatusNotFound, newGraphqlError(err.Error(), codePersistedQueryNotFound)
+	case errors.Is(err, service.ErrPersistedQueryNotSupported):
+		status, gqlErr = http.StatusBadRequest, newGraphqlError(err.Error(), codePersistedQueryNotSupported)
+	case errors.Is(err, service.ErrQueryNotAllowed):
+		status, gqlErr = http.StatusForbidden, newGraphqlError("Only persisted queries are allowed", codeForbidden)
+	default:
+		status, gqlErr = http.StatusBadRequest, newGraphqlError(err.Error(), codeBadRequest)
+	}
+	return "", "", status, &gqlErr
+}
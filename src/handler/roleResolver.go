@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/service"
+	"net/http"
+	"strings"
+)
+
+type roleResolver struct {
+	jwtService *service.JwtService
+}
+
+// resolveRoles returns the roles of the caller together with the claims of its token,
+// claims are empty if the auth mode does not carry any.
+func (r roleResolver) resolveRoles(ctx context.Context, options config.AuthOptions, header http.Header) ([]string, map[string]interface{}, error) {
+	switch options.Mode {
+	case "jwt":
+		return r.resolveRolesFromJwt(ctx, options.JwtOptions, header)
+	case "header":
+		roles, err := r.resolveRolesFromHeader(options.HeaderOptions, header)
+		return roles, map[string]interface{}{}, err
+	}
+	return nil, nil, fmt.Errorf("mode %s is not a valid auth mode", options.Mode)
+}
+
+func (r roleResolver) resolveRolesFromJwt(ctx context.Context, options config.JwtOptions, header http.Header) ([]string, map[string]interface{}, error) {
+	token, err := r.jwtService.Parse(header.Get("Authorization"), options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims, err := token.AsMap(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rolesInterface, exists := token.Get(options.RoleClaim)
+	if !exists {
+		return nil, nil, err
+	}
+
+	rolesString, ok := rolesInterface.(string)
+	if !ok {
+		return nil, nil, err
+	}
+
+	return strings.Split(rolesString, ","), claims, nil
+}
+
+func (r roleResolver) resolveRolesFromHeader(options config.HeaderOptions, header http.Header) ([]string, error) {
+	headerVal := header.Get(options.Name)
+	if headerVal == "" {
+		return nil, fmt.Errorf("header %s has no value", options.Name)
+	}
+	return strings.Split(headerVal, ","), nil
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-iam/agent/src/config"
+	"net"
+	"strings"
+)
+
+// matchRoute returns the first route registered for the matched path whose host and header match the request.
+func matchRoute(routes []config.Route, context *gin.Context) (config.Route, bool) {
+	for _, route := range routes {
+		if route.Path != context.FullPath() {
+			continue
+		}
+		if route.Host != "" && !matchHost(route.Host, context.Request.Host) {
+			continue
+		}
+		if route.Header.Name != "" {
+			value := context.GetHeader(route.Header.Name)
+			if value == "" || (route.Header.Value != "" && value != route.Header.Value) {
+				continue
+			}
+		}
+		return route, true
+	}
+	return config.Route{}, false
+}
+
+// matchHost compares the hosts ignoring the port of the request unless the route names one.
+func matchHost(routeHost string, requestHost string) bool {
+	if strings.EqualFold(routeHost, requestHost) {
+		return true
+	}
+	hostname, _, err := net.SplitHostPort(requestHost)
+	return err == nil && strings.EqualFold(routeHost, hostname)
+}
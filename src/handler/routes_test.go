@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"github.com/graphql-iam/agent/src/config"
+	"net/http"
+	"testing"
+)
+
+func TestPolicyProxy_MatchRoute(t *testing.T) {
+	hostUpstream := newRecordingUpstream(t, `{"data":{"route":"host"}}`)
+	headerUpstream := newRecordingUpstream(t, `{"data":{"route":"header"}}`)
+	anyValueUpstream := newRecordingUpstream(t, `{"data":{"route":"any value"}}`)
+
+	cfg := newTestConfig(hostUpstream.URL)
+	cfg.Routes[0].Name = "host"
+	cfg.Routes[0].Host = "api.example.com"
+	headerRoute := cfg.Routes[0]
+	headerRoute.Name = "header"
+	headerRoute.Host = ""
+	headerRoute.SourceUrl = headerUpstream.URL
+	headerRoute.Header = config.HeaderMatch{Name: "X-Tenant", Value: "acme"}
+	anyValueRoute := headerRoute
+	anyValueRoute.Name = "any value"
+	anyValueRoute.SourceUrl = anyValueUpstream.URL
+	anyValueRoute.Header = config.HeaderMatch{Name: "X-Client"}
+	cfg.Routes = append(cfg.Routes, headerRoute, anyValueRoute)
+	router := newTestRouter(t, cfg)
+
+	tests := []struct {
+		name    string
+		host    string
+		headers map[string]string
+		status  int
+		route   string
+	}{
+		{"host", "api.example.com", nil, http.StatusOK, "host"},
+		{"host with port", "API.example.com:8080", nil, http.StatusOK, "host"},
+		{"host takes precedence", "api.example.com", map[string]string{"X-Tenant": "acme"}, http.StatusOK, "host"},
+		{"header", "other.example.com", map[string]string{"X-Tenant": "acme"}, http.StatusOK, "header"},
+		{"header with other value", "other.example.com", map[string]string{"X-Tenant": "other", "X-Client": "web"}, http.StatusOK, "any value"},
+		{"header with any value", "other.example.com", map[string]string{"X-Client": "web"}, http.StatusOK, "any value"},
+		{"no route", "other.example.com", map[string]string{"X-Tenant": "other"}, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newPostRequest(`{"query":"{ public { news } }"}`, "reader")
+			request.Host = test.host
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			recorder := serve(router, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body.String())
+			}
+			if test.route != "" && recorder.Body.String() != `{"data":{"route":"`+test.route+`"}}` {
+				t.Fatalf("Expected route %s to answer, got %s", test.route, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/service"
+	"github.com/graphql-iam/agent/src/upstream"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const graphqlTransportWsProtocol = "graphql-transport-ws"
+
+// close codes of the graphql-transport-ws protocol
+const (
+	closeBadRequest       = 4400
+	closeForbidden        = 4403
+	closeUnacceptable     = 4406
+	closeInitTimeout      = 4408
+	closeTooManyInitCalls = 4429
+)
+
+const (
+	messageConnectionInit = "connection_init"
+	messageConnectionAck  = "connection_ack"
+	messageSubscribe      = "subscribe"
+	messageNext           = "next"
+	messageError          = "error"
+	messageComplete       = "complete"
+)
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// subscribePayload is forwarded re-encoded, so the upstream server reads exactly the fields that
+// were authorized, even if the client sent keys that differ only in case. The variables are kept
+// as sent, keys of maps are matched exactly like by the upstream server.
+type subscribePayload struct {
+	Query      string             `json:"query"`
+	Operation  string             `json:"operationName,omitempty"`
+	Variables  json.RawMessage    `json:"variables,omitempty"`
+	Extensions *requestExtensions `json:"extensions,omitempty"`
+}
+
+// SubscriptionProxy relays graphql-transport-ws connections to the upstream server. The caller
+// is authenticated on connection_init and every subscribe message is authorized before it is forwarded.
+type SubscriptionProxy struct {
+	cfg                   config.Config
+	roleResolver          roleResolver
+	authService           *service.AuthService
+	schemaService         *service.SchemaService
+	persistedQueryService *service.PersistedQueryService
+	upgrader              websocket.Upgrader
+	dialer                websocket.Dialer
+}
+
+func NewSubscriptionProxy(cfg config.Config, jwtService *service.JwtService, authService *service.AuthService, schemaService *service.SchemaService, persistedQueryService *service.PersistedQueryService, upstreamClient *upstream.Client) SubscriptionProxy {
+	return SubscriptionProxy{
+		cfg:                   cfg,
+		roleResolver:          roleResolver{jwtService: jwtService},
+		authService:           authService,
+		schemaService:         schemaService,
+		persistedQueryService: persistedQueryService,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{graphqlTransportWsProtocol},
+			CheckOrigin:  checkOrigin(cfg.CorsOptions),
+		},
+		dialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			Subprotocols:     []string{graphqlTransportWsProtocol},
+			HandshakeTimeout: time.Duration(cfg.Upstream.DialTimeoutSec+cfg.Upstream.ResponseHeaderTimeoutSec) * time.Second,
+			TLSClientConfig:  upstreamClient.TLSConfig(),
+		},
+	}
+}
+
+// checkOrigin allows the origins of the cors options, gorilla's same origin check is used if none are configured.
+func checkOrigin(cors config.CorsOptions) func(r *http.Request) bool {
+	if len(cors.AllowOrigins) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		return slices.Contains(cors.AllowOrigins, "*") || slices.Contains(cors.AllowOrigins, r.Header.Get("Origin"))
+	}
+}
+
+type subscriptionSession struct {
+	proxy    *SubscriptionProxy
+	route    config.Route
+	request  *http.Request
+	client   *websocket.Conn
+	upstream *websocket.Conn
+	writeMu  sync.Mutex
+	close    sync.Once
+	// rewrites holds the responseRewrite of the results of a subscription by its id
+	rewrites sync.Map
+	roles    []string
+	claims   map[string]interface{}
+}
+
+func (s *SubscriptionProxy) Handler(context *gin.Context) {
+	route, ok := matchRoute(s.cfg.Routes, context)
+	if !ok {
+		abortWithGraphqlErrors(context, s.cfg, http.StatusNotFound, newGraphqlError("No route matches the request", codeNotFound))
+		return
+	}
+
+	client, err := s.upgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		log.Printf("failed to upgrade subscription connection: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	session := &subscriptionSession{
+		proxy:   s,
+		route:   route,
+		request: context.Request,
+		client:  client,
+	}
+
+	if client.Subprotocol() != graphqlTransportWsProtocol {
+		session.closeWith(closeUnacceptable, "Subprotocol not acceptable")
+		return
+	}
+
+	if !session.init() {
+		return
+	}
+	defer session.upstream.Close()
+
+	if expiry, ok := session.claims["exp"].(time.Time); ok {
+		timer := time.AfterFunc(time.Until(expiry), func() {
+			session.closeWith(closeForbidden, "Forbidden: token expired")
+		})
+		defer timer.Stop()
+	}
+
+	go session.relayUpstream()
+	session.relayClient()
+}
+
+// init waits for connection_init, authenticates the caller with the headers of the upgrade
+// request overridden by the init payload and opens the upstream connection.
+func (s *subscriptionSession) init() bool {
+	timeout := time.Duration(s.proxy.cfg.Subscriptions.InitTimeoutSec) * time.Second
+	_ = s.client.SetReadDeadline(time.Now().Add(timeout))
+
+	var init wsMessage
+	err := s.client.ReadJSON(&init)
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			s.closeWith(closeInitTimeout, "Connection initialisation timeout")
+		} else {
+			s.closeWith(closeBadRequest, "Invalid message received")
+		}
+		return false
+	}
+	if init.Type != messageConnectionInit {
+		s.closeWith(closeBadRequest, "Expected connection_init")
+		return false
+	}
+	_ = s.client.SetReadDeadline(time.Time{})
+
+	header := headerWithInitPayload(s.request.Header, init.Payload)
+	s.roles, s.claims, err = s.proxy.roleResolver.resolveRoles(s.request.Context(), s.route.Auth, header)
+	if err != nil {
+		log.Printf("Error resolving roles: %v\n", err)
+		s.closeWith(closeForbidden, "Forbidden")
+		return false
+	}
+
+	s.upstream, err = s.dialUpstream(header, init)
+	if err != nil {
+		log.Printf("failed to connect to upstream subscription server: %v\n", err)
+		s.closeWith(websocket.CloseInternalServerErr, "Upstream unavailable")
+		return false
+	}
+
+	return s.writeClient(wsMessage{Type: messageConnectionAck}) == nil
+}
+
+func (s *subscriptionSession) dialUpstream(header http.Header, init wsMessage) (*websocket.Conn, error) {
+	dialer := s.proxy.dialer
+
+	upstreamHeader := http.Header{}
+	for name, values := range header {
+		if isHandshakeHeader(name) {
+			continue
+		}
+		upstreamHeader[name] = values
+	}
+
+	conn, _, err := dialer.DialContext(s.request.Context(), s.route.SubscriptionUrl, upstreamHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.WriteJSON(init)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(dialer.HandshakeTimeout))
+	for {
+		var message wsMessage
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if message.Type == messageConnectionAck {
+			_ = conn.SetReadDeadline(time.Time{})
+			return conn, nil
+		}
+	}
+}
+
+func (s *subscriptionSession) relayUpstream() {
+	for {
+		messageType, data, err := s.upstream.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, "Upstream closed"
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived && closeErr.Code != websocket.CloseAbnormalClosure {
+				code, text = closeErr.Code, closeErr.Text
+			}
+			s.closeWith(code, text)
+			return
+		}
+
+		data, err = s.rewriteResult(data)
+		if err != nil {
+			log.Printf("failed to rewrite subscription result: %v\n", err)
+			s.closeWith(websocket.CloseInternalServerErr, "")
+			return
+		}
+
+		s.writeMu.Lock()
+		err = s.client.WriteMessage(messageType, data)
+		s.writeMu.Unlock()
+		if err != nil {
+			s.closeWith(websocket.CloseInternalServerErr, "")
+			return
+		}
+	}
+}
+
+func (s *subscriptionSession) relayClient() {
+	for {
+		messageType, data, err := s.client.ReadMessage()
+		if err != nil {
+			s.closeWith(websocket.CloseNormalClosure, "")
+			return
+		}
+
+		var message wsMessage
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			s.closeWith(closeBadRequest, "Invalid message received")
+			return
+		}
+
+		switch message.Type {
+		case messageConnectionInit:
+			s.closeWith(closeTooManyInitCalls, "Too many initialisation requests")
+			return
+		case messageSubscribe:
+			var ok bool
+			message, ok = s.authorizeSubscribe(message)
+			if !ok {
+				continue
+			}
+		case messageComplete:
+			s.rewrites.Delete(message.ID)
+		}
+
+		// the parsed message is forwarded instead of the received one, whose keys the upstream
+		// server might read differently
+		data, err = json.Marshal(message)
+		if err != nil {
+			s.closeWith(closeBadRequest, "Invalid message received")
+			return
+		}
+
+		err = s.upstream.WriteMessage(messageType, data)
+		if err != nil {
+			s.closeWith(websocket.CloseInternalServerErr, "Upstream unavailable")
+			return
+		}
+	}
+}
+
+// authorizeSubscribe answers denied subscribe messages with an error message for their id.
+// It returns the message to forward, which carries the query if the client only sent its hash.
+func (s *subscriptionSession) authorizeSubscribe(message wsMessage) (wsMessage, bool) {
+	var payload subscribePayload
+	var variables map[string]interface{}
+	err := json.Unmarshal(message.Payload, &payload)
+	if err == nil && len(payload.Variables) > 0 {
+		err = json.Unmarshal(payload.Variables, &variables)
+	}
+	if err != nil {
+		s.sendError(message.ID, newGraphqlError("Invalid subscribe payload", codeBadRequest))
+		return wsMessage{}, false
+	}
+
+	var extensions requestExtensions
+	if payload.Extensions != nil {
+		extensions = *payload.Extensions
+	}
+	query, hash, _, gqlErr := resolvePersistedQuery(s.proxy.persistedQueryService, payload.Query, extensions)
+	if gqlErr != nil {
+		s.sendError(message.ID, *gqlErr)
+		return wsMessage{}, false
+	}
+	payload.Query = query
+	message.Payload, err = json.Marshal(payload)
+	if err != nil {
+		s.sendError(message.ID, newGraphqlError("Failed to create request", codeInternalError))
+		return wsMessage{}, false
+	}
+
+	if gqlErrors := validateRequest(s.proxy.schemaService, s.route, payload.Query, payload.Operation, variables); len(gqlErrors) > 0 {
+		s.sendError(message.ID, gqlErrors...)
+		return wsMessage{}, false
+	}
+
+	authRequest := service.AuthRequest{
+		Route:         s.route.Name,
+		Namespace:     s.route.PolicyNamespace,
+		Roles:         s.roles,
+		Claims:        s.claims,
+		Request:       *s.request,
+		Variables:     variables,
+		Query:         payload.Query,
+		OperationName: payload.Operation,
+		Schema:        s.proxy.schemaService.Schema(s.route.Name),
+		QueryHash:     hash,
+	}
+	decision, err := s.proxy.authService.AuthorizeWithRoles(authRequest)
+	if err != nil {
+		log.Printf("subscription was denied with error: %v\n", err)
+		s.sendError(message.ID, newGraphqlError("Could not authorize request", codeInternalError))
+		return wsMessage{}, false
+	}
+
+	if decision.Introspection && s.proxy.cfg.Introspection.Block {
+		s.sendError(message.ID, newIntrospectionDisabledError())
+		return wsMessage{}, false
+	}
+
+	if !decision.Allowed {
+		log.Printf("Subscription was denied: %s\n", strings.Join(decision.Reasons(), "; "))
+		_, gqlErr := newDeniedError(s.proxy.cfg, decision)
+		s.sendError(message.ID, gqlErr)
+		return wsMessage{}, false
+	}
+
+	if rewrite := introspectionRewrite(s.proxy.cfg, s.proxy.authService, authRequest, decision); rewrite != nil {
+		s.rewrites.Store(message.ID, rewrite)
+	}
+	return message, true
+}
+
+// rewriteResult applies the rewrite of a subscription to its next messages. The rewrite is
+// dropped once the upstream ends the subscription.
+func (s *subscriptionSession) rewriteResult(data []byte) ([]byte, error) {
+	var message wsMessage
+	if json.Unmarshal(data, &message) != nil || message.ID == "" {
+		return data, nil
+	}
+	value, ok := s.rewrites.Load(message.ID)
+	if !ok {
+		return data, nil
+	}
+
+	switch message.Type {
+	case messageNext:
+		payload, err := value.(responseRewrite)(message.Payload)
+		if err != nil {
+			return nil, err
+		}
+		message.Payload = payload
+		return json.Marshal(message)
+	case messageError, messageComplete:
+		s.rewrites.Delete(message.ID)
+	}
+	return data, nil
+}
+
+func (s *subscriptionSession) sendError(id string, gqlErrors ...graphqlError) {
+	payload, err := json.Marshal(gqlErrors)
+	if err != nil {
+		return
+	}
+	_ = s.writeClient(wsMessage{ID: id, Type: messageError, Payload: payload})
+}
+
+func (s *subscriptionSession) writeClient(message wsMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.client.WriteJSON(message)
+}
+
+// closeWith closes both connections, the client receives the given close code.
+func (s *subscriptionSession) closeWith(code int, text string) {
+	s.close.Do(func() {
+		s.writeMu.Lock()
+		_ = s.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+		s.writeMu.Unlock()
+		s.client.Close()
+		if s.upstream != nil {
+			s.upstream.Close()
+		}
+	})
+}
+
+// headerWithInitPayload adds the string values of the connection_init payload to the headers,
+// clients can't set headers on browser websockets and send their credentials in the payload instead.
+func headerWithInitPayload(header http.Header, payload json.RawMessage) http.Header {
+	result := header.Clone()
+
+	var values map[string]interface{}
+	if len(payload) == 0 || json.Unmarshal(payload, &values) != nil {
+		return result
+	}
+	if headers, ok := values["headers"].(map[string]interface{}); ok {
+		values = headers
+	}
+	for name, value := range values {
+		if str, ok := value.(string); ok {
+			result.Set(name, str)
+		}
+	}
+	return result
+}
+
+func isHandshakeHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Upgrade", "Connection", "Host", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol":
+		return true
+	}
+	return false
+}
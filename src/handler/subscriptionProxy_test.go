@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSubscriptionUpstream acknowledges connection_init, answers every subscribe with a next message
+// and sends the payloads of the subscribe messages it received to the returned channel.
+func newSubscriptionUpstream(t *testing.T) (*httptest.Server, chan json.RawMessage) {
+	subscribed := make(chan json.RawMessage, 10)
+	upgrader := websocket.Upgrader{Subprotocols: []string{graphqlTransportWsProtocol}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var message wsMessage
+			if conn.ReadJSON(&message) != nil {
+				return
+			}
+			switch message.Type {
+			case messageConnectionInit:
+				_ = conn.WriteJSON(wsMessage{Type: messageConnectionAck})
+			case messageSubscribe:
+				subscribed <- message.Payload
+				_ = conn.WriteJSON(wsMessage{ID: message.ID, Type: messageNext, Payload: json.RawMessage(`{"data":{"public":{"news":"hello"}}}`)})
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, subscribed
+}
+
+func newSubscriptionTestConfig(upstreamUrl string) config.Config {
+	cfg := newTestConfig(upstreamUrl)
+	cfg.Subscriptions = config.SubscriptionOptions{Enabled: true, InitTimeoutSec: 1}
+	cfg.Upstream.DialTimeoutSec = 1
+	cfg.Upstream.ResponseHeaderTimeoutSec = 1
+	return cfg
+}
+
+// dialSubscriptionProxy opens a graphql-transport-ws connection to the proxy and sends connection_init
+// with the init payload unless it is nil.
+func dialSubscriptionProxy(t *testing.T, cfg config.Config, header http.Header, initPayload interface{}) *websocket.Conn {
+	proxyServer := httptest.NewServer(newTestRouter(t, cfg))
+	t.Cleanup(proxyServer.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{graphqlTransportWsProtocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(proxyServer.URL, "http")+"/graphql", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if initPayload != nil {
+		payload, _ := json.Marshal(initPayload)
+		if err = conn.WriteJSON(wsMessage{Type: messageConnectionInit, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+// readMessage reads the next message from the proxy and fails if the connection was closed.
+func readMessage(t *testing.T, conn *websocket.Conn) wsMessage {
+	var message wsMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("Expected a message, got %v", err)
+	}
+	return message
+}
+
+// expectClose reads from the proxy until the connection is closed and compares the close code and text.
+func expectClose(t *testing.T, conn *websocket.Conn, code int, text string) {
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != code || closeErr.Text != text {
+			t.Fatalf("Expected close %d %q, got %v", code, text, err)
+		}
+		return
+	}
+}
+
+func subscribe(t *testing.T, conn *websocket.Conn, id string, payload string) {
+	if err := conn.WriteJSON(wsMessage{ID: id, Type: messageSubscribe, Payload: json.RawMessage(payload)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriptionProxy_Init(t *testing.T) {
+	tests := []struct {
+		name        string
+		initPayload interface{}
+		first       *wsMessage
+		code        int
+		text        string
+	}{
+		{
+			name: "init timeout",
+			code: closeInitTimeout,
+			text: "Connection initialisation timeout",
+		},
+		{
+			name:  "subscribe before init",
+			first: &wsMessage{ID: "1", Type: messageSubscribe, Payload: json.RawMessage(`{"query":"subscription { public { news } }"}`)},
+			code:  closeBadRequest,
+			text:  "Expected connection_init",
+		},
+		{
+			name:        "missing roles",
+			initPayload: map[string]string{},
+			code:        closeForbidden,
+			text:        "Forbidden",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamServer, subscribed := newSubscriptionUpstream(t)
+			conn := dialSubscriptionProxy(t, newSubscriptionTestConfig(upstreamServer.URL), nil, test.initPayload)
+			if test.first != nil {
+				if err := conn.WriteJSON(test.first); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expectClose(t, conn, test.code, test.text)
+			if len(subscribed) > 0 {
+				t.Fatalf("Expected nothing to be forwarded, got %s", <-subscribed)
+			}
+		})
+	}
+}
+
+func TestSubscriptionProxy_Subscribe(t *testing.T) {
+	public := "subscription { public { news } }"
+	account := "subscription { account { email } }"
+
+	tests := []struct {
+		name      string
+		payload   string
+		forwarded string
+	}{
+		{
+			name:      "allowed",
+			payload:   `{"query":"` + public + `","variables":{"id":"1"}}`,
+			forwarded: `{"query":"` + public + `","variables":{"id":"1"}}`,
+		},
+		{
+			name:    "denied",
+			payload: `{"query":"` + account + `"}`,
+		},
+		{
+			name:    "denied with a case variant key",
+			payload: `{"query":"` + public + `","Query":"` + account + `"}`,
+		},
+		{
+			name:      "allowed with a case variant key",
+			payload:   `{"Query":"` + account + `","query":"` + public + `"}`,
+			forwarded: `{"query":"` + public + `"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamServer, subscribed := newSubscriptionUpstream(t)
+			conn := dialSubscriptionProxy(t, newSubscriptionTestConfig(upstreamServer.URL), nil, map[string]string{"X-Roles": "reader"})
+			if ack := readMessage(t, conn); ack.Type != messageConnectionAck {
+				t.Fatalf("Expected connection_ack, got %+v", ack)
+			}
+
+			subscribe(t, conn, "1", test.payload)
+			message := readMessage(t, conn)
+
+			if test.forwarded == "" {
+				if message.ID != "1" || message.Type != messageError || !strings.Contains(string(message.Payload), codeForbidden) {
+					t.Fatalf("Expected a forbidden error for the subscription, got %+v", message)
+				}
+				if len(subscribed) > 0 {
+					t.Fatalf("Expected nothing to be forwarded, got %s", <-subscribed)
+				}
+				return
+			}
+			if message.ID != "1" || message.Type != messageNext {
+				t.Fatalf("Expected the result of the subscription, got %+v", message)
+			}
+			if forwarded := string(<-subscribed); forwarded != test.forwarded {
+				t.Fatalf("Expected %s to be forwarded, got %s", test.forwarded, forwarded)
+			}
+		})
+	}
+}
+
+func TestSubscriptionProxy_TokenExpiry(t *testing.T) {
+	key, err := jwk.FromRaw([]byte("a secret of the subscription test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJson, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewBuilder().Claim("roles", "reader").Expiration(time.Now().Add(2 * time.Second)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.HS256, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamServer, _ := newSubscriptionUpstream(t)
+	cfg := newSubscriptionTestConfig(upstreamServer.URL)
+	cfg.Routes[0].Auth = config.AuthOptions{
+		Mode:       "jwt",
+		JwtOptions: config.JwtOptions{SigningMethod: "HS256", Key: string(keyJson), RoleClaim: "roles"},
+	}
+	conn := dialSubscriptionProxy(t, cfg, nil, map[string]string{"Authorization": "Bearer " + string(signed)})
+
+	if ack := readMessage(t, conn); ack.Type != messageConnectionAck {
+		t.Fatalf("Expected connection_ack, got %+v", ack)
+	}
+	expectClose(t, conn, closeForbidden, "Forbidden: token expired")
+}
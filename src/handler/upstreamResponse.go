@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders only apply to a single connection and are not forwarded by proxies, see RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeaders copies all end-to-end headers, skipping hop-by-hop headers and the ones named in Connection.
+func copyHeaders(dst http.Header, src http.Header, skip ...string) {
+	excluded := make(map[string]bool)
+	for _, name := range append(hopByHopHeaders, skip...) {
+		excluded[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, connectionValue := range src.Values("Connection") {
+		for _, name := range strings.Split(connectionValue, ",") {
+			excluded[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for name, values := range src {
+		if excluded[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// graphqlResponseMediaTypes are the media types of GraphQL responses with a single JSON body.
+// Responses buffered to be rewritten are requested in one of them.
+var graphqlResponseMediaTypes = []string{"application/graphql-response+json", "application/json"}
+
+// isJsonResponse reports whether the response has one of the graphqlResponseMediaTypes.
+func isJsonResponse(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, jsonType := range graphqlResponseMediaTypes {
+		if mediaType == jsonType {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncremental reports whether the response is delivered in parts, like @defer and @stream
+// multipart responses or event streams, which have to be flushed to the client as they arrive.
+func isIncremental(contentType string) bool {
+	return strings.HasPrefix(contentType, "multipart/mixed") || strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// streamResponse writes the upstream response to the client without buffering it.
+func streamResponse(context *gin.Context, response *http.Response) error {
+	copyHeaders(context.Writer.Header(), response.Header)
+	context.Status(response.StatusCode)
+	context.Writer.WriteHeaderNow()
+
+	if !isIncremental(response.Header.Get("Content-Type")) {
+		_, err := io.Copy(context.Writer, response.Body)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buf)
+		if n > 0 {
+			_, writeErr := context.Writer.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			context.Writer.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
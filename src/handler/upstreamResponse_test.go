@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCopyHeaders(t *testing.T) {
+	src := http.Header{}
+	src.Set("Content-Type", "application/json")
+	src.Set("Content-Length", "42")
+	src.Add("X-Request-Id", "1")
+	src.Add("X-Request-Id", "2")
+	src.Set("Connection", "keep-alive, x-secret")
+	src.Set("X-Secret", "secret")
+	src.Set("Keep-Alive", "timeout=5")
+	src.Set("Transfer-Encoding", "chunked")
+	src.Set("Te", "trailers")
+	src.Set("Upgrade", "websocket")
+
+	dst := http.Header{}
+	copyHeaders(dst, src, "content-length")
+
+	expected := http.Header{
+		"Content-Type": {"application/json"},
+		"X-Request-Id": {"1", "2"},
+	}
+	if len(dst) != len(expected) {
+		t.Fatalf("Expected headers %v, got %v", expected, dst)
+	}
+	for name, values := range expected {
+		if len(dst.Values(name)) != len(values) || dst.Get(name) != values[0] {
+			t.Fatalf("Expected header %s to be %v, got %v", name, values, dst.Values(name))
+		}
+	}
+}
+
+func TestIsJsonResponse(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/graphql-response+json", true},
+		{"Application/JSON", true},
+		{"text/event-stream", false},
+		{"multipart/mixed; boundary=-", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if actual := isJsonResponse(test.contentType); actual != test.expected {
+			t.Errorf("isJsonResponse(%q): expected %v, got %v", test.contentType, test.expected, actual)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package model
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 type policyEffect string
 
 const (
@@ -19,14 +24,65 @@ type Policy struct {
 	Statements []Statement `json:"statements"`
 }
 
+// Statement applies to the actions matching a pattern of action, or to every action matching none
+// of notAction. The same goes for resource and notResource.
 type Statement struct {
-	Sid       string       `json:"sid,omitempty"`
-	Action    string       `json:"action"`
-	Effect    policyEffect `json:"effect"`
-	Resource  string       `json:"resource"`
-	Condition Condition    `json:"condition,omitempty"`
+	Sid         string       `json:"sid,omitempty"`
+	Action      Patterns     `json:"action,omitempty"`
+	NotAction   Patterns     `json:"notAction,omitempty"`
+	Effect      policyEffect `json:"effect"`
+	Resource    Patterns     `json:"resource,omitempty"`
+	NotResource Patterns     `json:"notResource,omitempty"`
+	Condition   Condition    `json:"condition,omitempty"`
+}
+
+// Patterns are glob patterns given as a single string or as a list of strings.
+type Patterns []string
+
+func (p *Patterns) UnmarshalJSON(data []byte) error {
+	return unmarshalStringOrList(data, (*[]string)(p))
+}
+
+// MarshalJSON keeps a single pattern a string like it was written.
+func (p Patterns) MarshalJSON() ([]byte, error) {
+	return marshalStringOrList(p)
+}
+
+func (p Patterns) String() string {
+	if len(p) == 1 {
+		return p[0]
+	}
+	return "[" + strings.Join(p, ", ") + "]"
 }
 
 type Condition map[string]ConditionParams
 
-type ConditionParams map[string]string
+type ConditionParams map[string]ConditionValues
+
+// ConditionValues are given as a single string or as a list of strings, a condition key is met
+// if any of its values matches.
+type ConditionValues []string
+
+func (v *ConditionValues) UnmarshalJSON(data []byte) error {
+	return unmarshalStringOrList(data, (*[]string)(v))
+}
+
+func (v ConditionValues) MarshalJSON() ([]byte, error) {
+	return marshalStringOrList(v)
+}
+
+func unmarshalStringOrList(data []byte, list *[]string) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*list = []string{single}
+		return nil
+	}
+	return json.Unmarshal(data, list)
+}
+
+func marshalStringOrList(list []string) ([]byte, error) {
+	if len(list) == 1 {
+		return json.Marshal(list[0])
+	}
+	return json.Marshal(list)
+}
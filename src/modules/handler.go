@@ -7,6 +7,7 @@ import (
 
 var Handler = fx.Module("handler",
 	fx.Provide(handler.NewPolicyProxy),
+	fx.Provide(handler.NewSubscriptionProxy),
 	fx.Provide(handler.NewHealthHandler),
 	fx.Provide(handler.NewCacheHandler),
 )
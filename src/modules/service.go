@@ -8,4 +8,6 @@ import (
 var Service = fx.Module("service",
 	fx.Provide(service.NewAuthService),
 	fx.Provide(service.NewJwtService),
+	fx.Provide(service.NewSchemaService),
+	fx.Provide(service.NewPersistedQueryService),
 )
@@ -0,0 +1,10 @@
+package modules
+
+import (
+	"github.com/graphql-iam/agent/src/upstream"
+	"go.uber.org/fx"
+)
+
+var Upstream = fx.Module("upstream",
+	fx.Provide(upstream.NewClient),
+)
@@ -24,28 +24,39 @@ func NewRolesRepository(cfg config.Config, c *cache.Cache, httpClient http.Clien
 	}
 }
 
-func (r *RolesRepository) GetRoleByName(name string) (model.Role, error) {
-	res, found := r.cache.Get(name)
+// RoleCacheKey is the key a role is cached under, roles of different policy namespaces may share names.
+func RoleCacheKey(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + ":" + name
+}
+
+func (r *RolesRepository) GetRoleByName(namespace string, name string) (model.Role, error) {
+	res, found := r.cache.Get(RoleCacheKey(namespace, name))
 	if found {
 		return res.(model.Role), nil
 	}
 
-	result, err := r.getRoleByNameFromManager(name)
+	result, err := r.getRoleByNameFromManager(namespace, name)
 	if err != nil {
 		return model.Role{}, err
 	}
 
-	r.cache.Set(name, result, cache.DefaultExpiration)
+	r.cache.Set(RoleCacheKey(namespace, name), result, cache.DefaultExpiration)
 	return result, nil
 }
 
-func (r *RolesRepository) getRoleByNameFromManager(name string) (model.Role, error) {
+func (r *RolesRepository) getRoleByNameFromManager(namespace string, name string) (model.Role, error) {
 	req, err := http.NewRequest("GET", r.cfg.ManagerUrl+"/role", nil)
 	if err != nil {
 		return model.Role{}, err
 	}
 	q := req.URL.Query()
 	q.Add("role", name)
+	if namespace != "" {
+		q.Add("namespace", namespace)
+	}
 	req.URL.RawQuery = q.Encode()
 
 	res, err := r.httpClient.Do(req)
@@ -60,12 +71,12 @@ func (r *RolesRepository) getRoleByNameFromManager(name string) (model.Role, err
 	return role, nil
 }
 
-func (r *RolesRepository) GetRolesByNames(names []string) ([]model.Role, error) {
+func (r *RolesRepository) GetRolesByNames(namespace string, names []string) ([]model.Role, error) {
 	var cacheResult []model.Role
 	unresolvedNames := names
 
 	for _, name := range names {
-		res, found := r.cache.Get(name)
+		res, found := r.cache.Get(RoleCacheKey(namespace, name))
 		if found {
 			cacheResult = append(cacheResult, res.(model.Role))
 			unresolvedNames = util.FilterArray(unresolvedNames, func(s string) bool {
@@ -77,25 +88,28 @@ func (r *RolesRepository) GetRolesByNames(names []string) ([]model.Role, error)
 		return cacheResult, nil
 	}
 
-	queryResult, err := r.getRolesByNamesFromManager(names)
+	queryResult, err := r.getRolesByNamesFromManager(namespace, names)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, role := range queryResult {
-		r.cache.Set(role.Name, role, cache.DefaultExpiration)
+		r.cache.Set(RoleCacheKey(namespace, role.Name), role, cache.DefaultExpiration)
 	}
 
 	return append(cacheResult, queryResult...), nil
 }
 
-func (r *RolesRepository) getRolesByNamesFromManager(names []string) ([]model.Role, error) {
+func (r *RolesRepository) getRolesByNamesFromManager(namespace string, names []string) ([]model.Role, error) {
 	req, err := http.NewRequest("GET", r.cfg.ManagerUrl+"/roles", nil)
 	if err != nil {
 		return nil, err
 	}
 	q := req.URL.Query()
 	q.Add("roles", strings.Join(names, ","))
+	if namespace != "" {
+		q.Add("namespace", namespace)
+	}
 	req.URL.RawQuery = q.Encode()
 
 	res, err := r.httpClient.Do(req)
@@ -0,0 +1,394 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"strings"
+)
+
+// IntrospectionQuery fetches everything needed to rebuild the schema of the upstream server.
+const IntrospectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types {
+      kind
+      name
+      fields(includeDeprecated: true) {
+        name
+        args { name type { ...TypeRef } }
+        type { ...TypeRef }
+      }
+      inputFields { name type { ...TypeRef } }
+      interfaces { ...TypeRef }
+      enumValues(includeDeprecated: true) { name }
+      possibleTypes { ...TypeRef }
+    }
+    directives {
+      name
+      locations
+      args { name type { ...TypeRef } }
+    }
+  }
+}
+
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType {
+    kind
+    name
+    ofType {
+      kind
+      name
+      ofType {
+        kind
+        name
+        ofType {
+          kind
+          name
+          ofType {
+            kind
+            name
+            ofType {
+              kind
+              name
+              ofType {
+                kind
+                name
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+// introspectionSchema mirrors the result of IntrospectionQuery, SDL documents are converted into it
+// so that both sources share the same builder.
+type introspectionSchema struct {
+	QueryType        *typeRef                 `json:"queryType"`
+	MutationType     *typeRef                 `json:"mutationType"`
+	SubscriptionType *typeRef                 `json:"subscriptionType"`
+	Types            []introspectionType      `json:"types"`
+	Directives       []introspectionDirective `json:"directives"`
+}
+
+type introspectionType struct {
+	Kind          string               `json:"kind"`
+	Name          string               `json:"name"`
+	Fields        []introspectionField `json:"fields"`
+	InputFields   []inputValue         `json:"inputFields"`
+	Interfaces    []typeRef            `json:"interfaces"`
+	EnumValues    []enumValue          `json:"enumValues"`
+	PossibleTypes []typeRef            `json:"possibleTypes"`
+}
+
+type introspectionField struct {
+	Name string       `json:"name"`
+	Args []inputValue `json:"args"`
+	Type typeRef      `json:"type"`
+}
+
+type inputValue struct {
+	Name string  `json:"name"`
+	Type typeRef `json:"type"`
+}
+
+type enumValue struct {
+	Name string `json:"name"`
+}
+
+type introspectionDirective struct {
+	Name      string       `json:"name"`
+	Locations []string     `json:"locations"`
+	Args      []inputValue `json:"args"`
+}
+
+type typeRef struct {
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	OfType *typeRef `json:"ofType"`
+}
+
+const (
+	kindScalar      = "SCALAR"
+	kindObject      = "OBJECT"
+	kindInterface   = "INTERFACE"
+	kindUnion       = "UNION"
+	kindEnum        = "ENUM"
+	kindInputObject = "INPUT_OBJECT"
+	kindList        = "LIST"
+	kindNonNull     = "NON_NULL"
+)
+
+var builtinScalars = map[string]*graphql.Scalar{
+	"String":  graphql.String,
+	"Int":     graphql.Int,
+	"Float":   graphql.Float,
+	"Boolean": graphql.Boolean,
+	"ID":      graphql.ID,
+}
+
+// FromIntrospection builds the schema from the response to IntrospectionQuery.
+func FromIntrospection(response []byte) (*graphql.Schema, error) {
+	var result struct {
+		Data struct {
+			Schema *introspectionSchema `json:"__schema"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := json.Unmarshal(response, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("introspection failed: %s", result.Errors[0].Message)
+	}
+	if result.Data.Schema == nil {
+		return nil, errors.New("introspection response contains no schema")
+	}
+	return build(*result.Data.Schema)
+}
+
+// builder creates the graphql-go types lazily so that types can reference each other in any order.
+// The schema is only used to look up and validate operations, nothing is ever resolved with it.
+type builder struct {
+	definitions map[string]introspectionType
+	types       map[string]graphql.Type
+	err         error
+}
+
+func build(s introspectionSchema) (*graphql.Schema, error) {
+	b := builder{
+		definitions: make(map[string]introspectionType),
+		types:       make(map[string]graphql.Type),
+	}
+	for _, definition := range s.Types {
+		b.definitions[definition.Name] = definition
+	}
+
+	if s.QueryType == nil {
+		return nil, errors.New("schema has no query type")
+	}
+	config := graphql.SchemaConfig{
+		Query:        b.object(s.QueryType.Name),
+		Mutation:     b.rootObject(s.MutationType),
+		Subscription: b.rootObject(s.SubscriptionType),
+	}
+	for _, definition := range s.Types {
+		if !strings.HasPrefix(definition.Name, "__") {
+			config.Types = append(config.Types, b.named(definition.Name))
+		}
+	}
+	config.Directives = b.directives(s.Directives)
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	schema, err := graphql.NewSchema(config)
+	if err != nil {
+		return nil, err
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &schema, nil
+}
+
+func (b *builder) fail(format string, args ...interface{}) {
+	if b.err == nil {
+		b.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (b *builder) rootObject(ref *typeRef) *graphql.Object {
+	if ref == nil || ref.Name == "" {
+		return nil
+	}
+	return b.object(ref.Name)
+}
+
+func (b *builder) object(name string) *graphql.Object {
+	object, ok := b.named(name).(*graphql.Object)
+	if !ok {
+		b.fail("type %s is not an object type", name)
+		return graphql.NewObject(graphql.ObjectConfig{Name: name, Fields: graphql.Fields{}})
+	}
+	return object
+}
+
+func (b *builder) named(name string) graphql.Type {
+	if scalar, ok := builtinScalars[name]; ok {
+		return scalar
+	}
+	if built, ok := b.types[name]; ok {
+		return built
+	}
+
+	definition, ok := b.definitions[name]
+	if !ok {
+		b.fail("unknown type %s", name)
+		definition = introspectionType{Kind: kindScalar, Name: name}
+	}
+
+	// types are registered before their fields are built, the thunks resolve cycles
+	switch definition.Kind {
+	case kindObject:
+		b.types[name] = graphql.NewObject(graphql.ObjectConfig{
+			Name: name,
+			Interfaces: graphql.InterfacesThunk(func() []*graphql.Interface {
+				var interfaces []*graphql.Interface
+				for _, ref := range definition.Interfaces {
+					if iface, ok := b.named(ref.Name).(*graphql.Interface); ok {
+						interfaces = append(interfaces, iface)
+					}
+				}
+				return interfaces
+			}),
+			Fields: b.fields(definition.Fields),
+		})
+	case kindInterface:
+		b.types[name] = graphql.NewInterface(graphql.InterfaceConfig{
+			Name:        name,
+			Fields:      b.fields(definition.Fields),
+			ResolveType: resolveNothing,
+		})
+	case kindUnion:
+		b.types[name] = graphql.NewUnion(graphql.UnionConfig{
+			Name: name,
+			Types: graphql.UnionTypesThunk(func() []*graphql.Object {
+				var objects []*graphql.Object
+				for _, ref := range definition.PossibleTypes {
+					objects = append(objects, b.object(ref.Name))
+				}
+				return objects
+			}),
+			ResolveType: resolveNothing,
+		})
+	case kindEnum:
+		values := graphql.EnumValueConfigMap{}
+		for _, value := range definition.EnumValues {
+			values[value.Name] = &graphql.EnumValueConfig{Value: value.Name}
+		}
+		b.types[name] = graphql.NewEnum(graphql.EnumConfig{Name: name, Values: values})
+	case kindInputObject:
+		b.types[name] = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name: name,
+			Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+				fields := graphql.InputObjectConfigFieldMap{}
+				for _, field := range definition.InputFields {
+					fields[field.Name] = &graphql.InputObjectFieldConfig{Type: b.input(field.Type)}
+				}
+				return fields
+			}),
+		})
+	default:
+		b.types[name] = customScalar(name)
+	}
+	return b.types[name]
+}
+
+func (b *builder) fields(definitions []introspectionField) graphql.FieldsThunk {
+	return func() graphql.Fields {
+		fields := graphql.Fields{}
+		for _, definition := range definitions {
+			output, ok := b.ref(definition.Type).(graphql.Output)
+			if !ok {
+				b.fail("field %s has no output type", definition.Name)
+				continue
+			}
+			fields[definition.Name] = &graphql.Field{
+				Type: output,
+				Args: b.args(definition.Args),
+			}
+		}
+		return fields
+	}
+}
+
+func (b *builder) args(definitions []inputValue) graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{}
+	for _, definition := range definitions {
+		args[definition.Name] = &graphql.ArgumentConfig{Type: b.input(definition.Type)}
+	}
+	return args
+}
+
+func (b *builder) input(ref typeRef) graphql.Input {
+	input, ok := b.ref(ref).(graphql.Input)
+	if !ok {
+		b.fail("type %s is not an input type", ref.Name)
+		return graphql.String
+	}
+	return input
+}
+
+func (b *builder) ref(ref typeRef) graphql.Type {
+	switch ref.Kind {
+	case kindNonNull, kindList:
+		if ref.OfType == nil {
+			b.fail("%s type without inner type", ref.Kind)
+			return graphql.String
+		}
+		inner := b.ref(*ref.OfType)
+		if ref.Kind == kindList {
+			return graphql.NewList(inner)
+		}
+		return graphql.NewNonNull(inner)
+	}
+	return b.named(ref.Name)
+}
+
+func (b *builder) directives(definitions []introspectionDirective) []*graphql.Directive {
+	directives := append([]*graphql.Directive{}, graphql.SpecifiedDirectives...)
+	for _, definition := range definitions {
+		if isSpecifiedDirective(definition.Name) {
+			continue
+		}
+		directives = append(directives, graphql.NewDirective(graphql.DirectiveConfig{
+			Name:      definition.Name,
+			Locations: definition.Locations,
+			Args:      b.args(definition.Args),
+		}))
+	}
+	return directives
+}
+
+func isSpecifiedDirective(name string) bool {
+	for _, directive := range graphql.SpecifiedDirectives {
+		if directive.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveNothing(graphql.ResolveTypeParams) *graphql.Object {
+	return nil
+}
+
+// customScalar accepts any value, the upstream server is responsible for validating custom scalars.
+func customScalar(name string) *graphql.Scalar {
+	return graphql.NewScalar(graphql.ScalarConfig{
+		Name: name,
+		Serialize: func(value interface{}) interface{} {
+			return value
+		},
+		ParseValue: func(value interface{}) interface{} {
+			return value
+		},
+		ParseLiteral: func(value ast.Value) interface{} {
+			return value.GetValue()
+		},
+	})
+}
@@ -0,0 +1,164 @@
+package schema
+
+import (
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// FromSDL builds the schema from a schema definition document. Without a schema definition
+// the root types are expected to be named Query, Mutation and Subscription.
+func FromSDL(sdl string) (*graphql.Schema, error) {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(sdl),
+		Name: "GraphQL schema",
+	})})
+	if err != nil {
+		return nil, err
+	}
+
+	var s introspectionSchema
+	var extensions []*ast.ObjectDefinition
+	names := make(map[string]bool)
+	unions := make(map[string][]typeRef)
+	implementations := make(map[string][]typeRef)
+
+	for _, definition := range document.Definitions {
+		switch def := definition.(type) {
+		case *ast.SchemaDefinition:
+			for _, operationType := range def.OperationTypes {
+				ref := &typeRef{Kind: kindObject, Name: operationType.Type.Name.Value}
+				switch operationType.Operation {
+				case ast.OperationTypeQuery:
+					s.QueryType = ref
+				case ast.OperationTypeMutation:
+					s.MutationType = ref
+				case ast.OperationTypeSubscription:
+					s.SubscriptionType = ref
+				}
+			}
+		case *ast.ObjectDefinition:
+			t := introspectionType{
+				Kind:       kindObject,
+				Name:       def.Name.Value,
+				Fields:     sdlFields(def.Fields),
+				Interfaces: namedRefs(def.Interfaces, kindInterface),
+			}
+			for _, iface := range def.Interfaces {
+				implementations[iface.Name.Value] = append(implementations[iface.Name.Value], typeRef{Kind: kindObject, Name: t.Name})
+			}
+			s.Types = append(s.Types, t)
+		case *ast.TypeExtensionDefinition:
+			extensions = append(extensions, def.Definition)
+		case *ast.InterfaceDefinition:
+			s.Types = append(s.Types, introspectionType{
+				Kind:   kindInterface,
+				Name:   def.Name.Value,
+				Fields: sdlFields(def.Fields),
+			})
+		case *ast.UnionDefinition:
+			unions[def.Name.Value] = namedRefs(def.Types, kindObject)
+			s.Types = append(s.Types, introspectionType{Kind: kindUnion, Name: def.Name.Value})
+		case *ast.EnumDefinition:
+			t := introspectionType{Kind: kindEnum, Name: def.Name.Value}
+			for _, value := range def.Values {
+				t.EnumValues = append(t.EnumValues, enumValue{Name: value.Name.Value})
+			}
+			s.Types = append(s.Types, t)
+		case *ast.InputObjectDefinition:
+			s.Types = append(s.Types, introspectionType{
+				Kind:        kindInputObject,
+				Name:        def.Name.Value,
+				InputFields: sdlInputValues(def.Fields),
+			})
+		case *ast.ScalarDefinition:
+			s.Types = append(s.Types, introspectionType{Kind: kindScalar, Name: def.Name.Value})
+		case *ast.DirectiveDefinition:
+			directive := introspectionDirective{
+				Name: def.Name.Value,
+				Args: sdlInputValues(def.Arguments),
+			}
+			for _, location := range def.Locations {
+				directive.Locations = append(directive.Locations, location.Value)
+			}
+			s.Directives = append(s.Directives, directive)
+		}
+	}
+
+	for i := range s.Types {
+		t := &s.Types[i]
+		names[t.Name] = true
+		switch t.Kind {
+		case kindUnion:
+			t.PossibleTypes = unions[t.Name]
+		case kindInterface:
+			t.PossibleTypes = implementations[t.Name]
+		}
+		for _, extension := range extensions {
+			if extension.Name.Value == t.Name {
+				t.Fields = append(t.Fields, sdlFields(extension.Fields)...)
+				t.Interfaces = append(t.Interfaces, namedRefs(extension.Interfaces, kindInterface)...)
+			}
+		}
+	}
+
+	if s.QueryType == nil && s.MutationType == nil && s.SubscriptionType == nil {
+		s.QueryType = defaultRoot(names, "Query")
+		s.MutationType = defaultRoot(names, "Mutation")
+		s.SubscriptionType = defaultRoot(names, "Subscription")
+	}
+	return build(s)
+}
+
+func defaultRoot(names map[string]bool, name string) *typeRef {
+	if !names[name] {
+		return nil
+	}
+	return &typeRef{Kind: kindObject, Name: name}
+}
+
+func sdlFields(definitions []*ast.FieldDefinition) []introspectionField {
+	var fields []introspectionField
+	for _, definition := range definitions {
+		fields = append(fields, introspectionField{
+			Name: definition.Name.Value,
+			Args: sdlInputValues(definition.Arguments),
+			Type: sdlTypeRef(definition.Type),
+		})
+	}
+	return fields
+}
+
+func sdlInputValues(definitions []*ast.InputValueDefinition) []inputValue {
+	var values []inputValue
+	for _, definition := range definitions {
+		values = append(values, inputValue{
+			Name: definition.Name.Value,
+			Type: sdlTypeRef(definition.Type),
+		})
+	}
+	return values
+}
+
+func namedRefs(named []*ast.Named, kind string) []typeRef {
+	var refs []typeRef
+	for _, n := range named {
+		refs = append(refs, typeRef{Kind: kind, Name: n.Name.Value})
+	}
+	return refs
+}
+
+func sdlTypeRef(t ast.Type) typeRef {
+	switch typ := t.(type) {
+	case *ast.NonNull:
+		inner := sdlTypeRef(typ.Type)
+		return typeRef{Kind: kindNonNull, OfType: &inner}
+	case *ast.List:
+		inner := sdlTypeRef(typ.Type)
+		return typeRef{Kind: kindList, OfType: &inner}
+	case *ast.Named:
+		return typeRef{Name: typ.Name.Value}
+	}
+	return typeRef{}
+}
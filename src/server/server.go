@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/graphql-iam/agent/src/config"
 	"github.com/graphql-iam/agent/src/handler"
 	"go.uber.org/fx"
@@ -11,9 +12,26 @@ import (
 	"net/http"
 )
 
-func NewServer(lc fx.Lifecycle, policyProxy handler.PolicyProxy, healthHandler handler.HealthHandler, cfg config.Config) *http.Server {
+func NewServer(lc fx.Lifecycle, policyProxy handler.PolicyProxy, subscriptionProxy handler.SubscriptionProxy, healthHandler handler.HealthHandler, cfg config.Config) *http.Server {
 	r := gin.Default()
-	r.POST(cfg.Path, policyProxy.Handler)
+
+	// routes may share a path and are told apart by host or header in the handlers
+	registered := make(map[string]bool)
+	for _, route := range cfg.Routes {
+		if registered[route.Path] {
+			continue
+		}
+		registered[route.Path] = true
+
+		r.POST(route.Path, policyProxy.Handler)
+		r.GET(route.Path, func(context *gin.Context) {
+			if cfg.Subscriptions.Enabled && websocket.IsWebSocketUpgrade(context.Request) {
+				subscriptionProxy.Handler(context)
+				return
+			}
+			policyProxy.Handler(context)
+		})
+	}
 	r.GET("/ping", healthHandler.Ping)
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("localhost:%d", cfg.Port),
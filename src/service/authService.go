@@ -1,36 +1,167 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/graphql-go/graphql"
 	"github.com/graphql-iam/agent/src/auth"
 	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/model"
 	"github.com/graphql-iam/agent/src/repository"
+	"github.com/patrickmn/go-cache"
+	"log"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 )
 
 type AuthService struct {
 	cfg             config.Config
 	rolesRepository *repository.RolesRepository
+	cache           *cache.Cache
+	boundaries      []model.Policy
 }
 
-func NewAuthService(cfg config.Config, rolesRepository *repository.RolesRepository) *AuthService {
+func NewAuthService(cfg config.Config, rolesRepository *repository.RolesRepository, c *cache.Cache) (*AuthService, error) {
+	var boundaries []model.Policy
+	if cfg.Boundaries.Path != "" {
+		bytes, err := os.ReadFile(cfg.Boundaries.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read boundaries: %w", err)
+		}
+		err = json.Unmarshal(bytes, &boundaries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse boundaries: %w", err)
+		}
+		log.Printf("loaded %d boundary policies\n", len(boundaries))
+	}
+
 	return &AuthService{
 		cfg:             cfg,
 		rolesRepository: rolesRepository,
+		cache:           c,
+		boundaries:      boundaries,
+	}, nil
+}
+
+// AuthRequest is a GraphQL operation together with the caller it is authorized for.
+// QueryHash is the persisted query hash of the query, decisions are cached by it if set.
+type AuthRequest struct {
+	Route         string
+	Namespace     string
+	Roles         []string
+	Claims        map[string]interface{}
+	Request       http.Request
+	Variables     map[string]interface{}
+	Query         string
+	OperationName string
+	Schema        *graphql.Schema
+	QueryHash     string
+}
+
+// AuthorizeWithRoles evaluates the roles of the request. Decisions of persisted queries are cached
+// per role set unless a condition was evaluated, which makes them depend on more than the query.
+func (a *AuthService) AuthorizeWithRoles(req AuthRequest) (auth.Decision, error) {
+	key := decisionCacheKey(req)
+	if key != "" {
+		if cached, found := a.cache.Get(key); found {
+			return cached.(auth.Decision), nil
+		}
+	}
+
+	roles, err := a.rolesRepository.GetRolesByNames(req.Namespace, req.Roles)
+	if err != nil {
+		return auth.Decision{}, fmt.Errorf("Error getting roles from manager: %v\n", err.Error())
+	}
+
+	pe, err := a.policyEvaluator(req)
+	if err != nil {
+		return auth.Decision{}, err
 	}
+	decision := pe.EvaluateRoles(roles)
+	if key != "" && !decision.Conditional {
+		a.cache.Set(key, decision, cache.DefaultExpiration)
+	}
+	return decision, nil
 }
 
-func (a *AuthService) AuthorizeWithRoles(rolesStr []string, request http.Request, Variables map[string]interface{}, query string) (bool, error) {
-	roles, err := a.rolesRepository.GetRolesByNames(rolesStr)
+// DecisionCachePrefix starts the cache keys of all cached decisions.
+const DecisionCachePrefix = "decision:"
+
+// decisionCacheKey identifies the decision by everything it depends on if no condition is evaluated,
+// the variables are included since they decide on @include and @skip. It is empty without a query hash.
+func decisionCacheKey(req AuthRequest) string {
+	if req.QueryHash == "" {
+		return ""
+	}
+	variables, err := json.Marshal(req.Variables)
 	if err != nil {
-		return false, fmt.Errorf("Error getting roles from manager: %v\n", err.Error())
+		return ""
 	}
+	roles := slices.Clone(req.Roles)
+	slices.Sort(roles)
+	return DecisionCachePrefix + strings.Join([]string{
+		req.Route,
+		req.Namespace,
+		strings.Join(roles, ","),
+		req.QueryHash,
+		req.OperationName,
+		HashQuery(string(variables)),
+	}, ":")
+}
 
-	pe := auth.PolicyEvaluator{
-		Request:   request,
-		Variables: Variables,
-		Query:     query,
+// FilterIntrospection removes everything the roles of the request may not see from the introspection results in body.
+func (a *AuthService) FilterIntrospection(req AuthRequest, decision auth.Decision, body []byte) ([]byte, error) {
+	roles, err := a.rolesRepository.GetRolesByNames(req.Namespace, req.Roles)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting roles from manager: %v\n", err.Error())
+	}
+
+	pe, err := a.policyEvaluator(req)
+	if err != nil {
+		return nil, err
+	}
+	return pe.FilterIntrospection(roles, decision, body)
+}
+
+func (a *AuthService) policyEvaluator(req AuthRequest) (auth.PolicyEvaluator, error) {
+	boundaries, err := a.getBoundaries()
+	if err != nil {
+		return auth.PolicyEvaluator{}, err
 	}
 
-	return pe.EvaluateRoles(roles), nil
+	return auth.PolicyEvaluator{
+		Request:       req.Request,
+		Variables:     req.Variables,
+		Query:         req.Query,
+		OperationName: req.OperationName,
+		Claims:        req.Claims,
+		Schema:        req.Schema,
+		Limits:        a.cfg.Limits,
+		Legacy:        a.cfg.LegacyEvaluation,
+		Boundaries:    boundaries,
+	}, nil
+}
+
+// getBoundaries returns the boundaries of the config file together with the policies of the boundary
+// roles. A boundary role missing in the manager is an error so that no boundary is silently skipped.
+func (a *AuthService) getBoundaries() ([]model.Policy, error) {
+	if len(a.cfg.Boundaries.Roles) == 0 {
+		return a.boundaries, nil
+	}
+
+	roles, err := a.rolesRepository.GetRolesByNames("", a.cfg.Boundaries.Roles)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting boundary roles from manager: %v\n", err.Error())
+	}
+	boundaries := slices.Clone(a.boundaries)
+	for _, name := range a.cfg.Boundaries.Roles {
+		index := slices.IndexFunc(roles, func(role model.Role) bool { return role.Name == name })
+		if index < 0 {
+			return nil, fmt.Errorf("boundary role %s not found", name)
+		}
+		boundaries = append(boundaries, roles[index].Policies...)
+	}
+	return boundaries, nil
 }
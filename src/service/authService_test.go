@@ -0,0 +1,132 @@
+package service
+
+import (
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/model"
+	"github.com/graphql-iam/agent/src/repository"
+	"github.com/patrickmn/go-cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecisionCacheKey(t *testing.T) {
+	base := AuthRequest{
+		Route:         "/graphql",
+		Namespace:     "default",
+		Roles:         []string{"reader", "admin"},
+		Variables:     map[string]interface{}{"id": "1"},
+		OperationName: "User",
+		QueryHash:     HashQuery(registeredQuery),
+	}
+	key := decisionCacheKey(base)
+
+	tests := []struct {
+		name   string
+		modify func(req *AuthRequest)
+		same   bool
+	}{
+		{"same request", func(req *AuthRequest) {}, true},
+		{"roles in another order", func(req *AuthRequest) { req.Roles = []string{"admin", "reader"} }, true},
+		{"other roles", func(req *AuthRequest) { req.Roles = []string{"reader"} }, false},
+		{"other route", func(req *AuthRequest) { req.Route = "/other" }, false},
+		{"other namespace", func(req *AuthRequest) { req.Namespace = "other" }, false},
+		{"other operation", func(req *AuthRequest) { req.OperationName = "Other" }, false},
+		{"other variables", func(req *AuthRequest) { req.Variables = map[string]interface{}{"id": "2"} }, false},
+		{"other query", func(req *AuthRequest) { req.QueryHash = HashQuery(manifestQuery) }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := base
+			test.modify(&req)
+			if same := decisionCacheKey(req) == key; same != test.same {
+				t.Fatalf("Expected the keys to be the same: %v, got %v", test.same, same)
+			}
+		})
+	}
+
+	base.QueryHash = ""
+	if key = decisionCacheKey(base); key != "" {
+		t.Fatalf("Expected no key without query hash, got %q", key)
+	}
+}
+
+func TestAuthService_AuthorizeWithRoles_Caching(t *testing.T) {
+	c := cache.New(cache.NoExpiration, 0)
+	c.Set(repository.RoleCacheKey("", "reader"), model.Role{
+		Name: "reader",
+		Policies: []model.Policy{
+			{
+				ID:      "1",
+				Name:    "reader",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowUsers",
+						Action:   model.Patterns{"query"},
+						Effect:   "allow",
+						Resource: model.Patterns{"users.*"},
+					},
+				},
+			},
+		},
+	}, cache.NoExpiration)
+	c.Set(repository.RoleCacheKey("", "tenant"), model.Role{
+		Name: "tenant",
+		Policies: []model.Policy{
+			{
+				ID:      "2",
+				Name:    "tenant",
+				Version: "1",
+				Statements: []model.Statement{
+					{
+						Sid:      "allowMe",
+						Action:   model.Patterns{"query"},
+						Effect:   "allow",
+						Resource: model.Patterns{"me.*"},
+						Condition: model.Condition{
+							"StringEquals": model.ConditionParams{"header:X-Tenant": model.ConditionValues{"acme"}},
+						},
+					},
+				},
+			},
+		},
+	}, cache.NoExpiration)
+	cfg := config.Config{}
+	a, err := NewAuthService(cfg, repository.NewRolesRepository(cfg, c, http.Client{}), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		role   string
+		query  string
+		cached bool
+	}{
+		{"unconditional decision", "reader", registeredQuery, true},
+		{"conditional decision", "tenant", manifestQuery, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := AuthRequest{
+				Roles:     []string{test.role},
+				Request:   *httptest.NewRequest("POST", "http://testing.com/graphql", nil),
+				Query:     test.query,
+				QueryHash: HashQuery(test.query),
+			}
+			decision, err := a.AuthorizeWithRoles(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Conditional == test.cached {
+				t.Fatalf("Expected the decision to be conditional: %v, got %+v", !test.cached, decision)
+			}
+			if _, found := c.Get(decisionCacheKey(req)); found != test.cached {
+				t.Fatalf("Expected the decision to be cached: %v, got %v", test.cached, found)
+			}
+		})
+	}
+}
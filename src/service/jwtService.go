@@ -11,31 +11,35 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 type JwtService struct {
-	cfg    config.Config
-	keySet *jwk.Set
+	keySets map[string]*jwk.Set
 }
 
 func NewJwtService(cfg config.Config) *JwtService {
-	return &JwtService{
-		cfg:    cfg,
-		keySet: getCachedJWKS(cfg),
+	keySets := make(map[string]*jwk.Set)
+	for _, route := range cfg.Routes {
+		jwksUrl := route.Auth.JwtOptions.JwksUrl
+		if route.Auth.Mode != "jwt" || jwksUrl == "" || keySets[jwksUrl] != nil {
+			continue
+		}
+		keySets[jwksUrl] = getCachedJWKS(jwksUrl)
 	}
-}
 
-func getCachedJWKS(cfg config.Config) *jwk.Set {
-	if cfg.Auth.JwtOptions.JwksUrl == "" {
-		return nil
+	return &JwtService{
+		keySets: keySets,
 	}
+}
 
+func getCachedJWKS(jwksUrl string) *jwk.Set {
 	jwkCache := jwk.NewCache(context.Background())
 
 	// register a minimum refresh interval for this URL.
 	// when not specified, defaults to cache-Control and similar resp headers
-	err := jwkCache.Register(cfg.Auth.JwtOptions.JwksUrl, jwk.WithMinRefreshInterval(10*time.Minute))
+	err := jwkCache.Register(jwksUrl, jwk.WithMinRefreshInterval(10*time.Minute))
 	if err != nil {
 		panic("failed to register jwk location")
 	}
@@ -44,30 +48,33 @@ func getCachedJWKS(cfg config.Config) *jwk.Set {
 	defer cancel()
 
 	// fetch once on application startup
-	_, err = jwkCache.Refresh(ctx, cfg.Auth.JwtOptions.JwksUrl)
+	_, err = jwkCache.Refresh(ctx, jwksUrl)
 	if err != nil {
 		panic("failed to fetch on startup")
 	}
 	// create the cached key set
-	cachedSet := jwk.NewCachedSet(jwkCache, cfg.Auth.JwtOptions.JwksUrl)
+	cachedSet := jwk.NewCachedSet(jwkCache, jwksUrl)
 
 	return &cachedSet
 }
 
-func (j *JwtService) Parse(authHeader string) (jwt.Token, error) {
-	tokenString := authHeader[len("Bearer "):]
+func (j *JwtService) Parse(authHeader string, options config.JwtOptions) (jwt.Token, error) {
+	tokenString, found := strings.CutPrefix(authHeader, "Bearer ")
+	if !found {
+		return nil, errors.New("authorization header is not a bearer token")
+	}
 
-	if j.keySet != nil {
-		return jwt.Parse([]byte(tokenString), jwt.WithKeySet(*j.keySet))
+	if keySet := j.keySets[options.JwksUrl]; keySet != nil {
+		return jwt.Parse([]byte(tokenString), jwt.WithKeySet(*keySet))
 	}
 
-	alg := jwa.KeyAlgorithmFrom(j.cfg.Auth.JwtOptions.SigningMethod)
+	alg := jwa.KeyAlgorithmFrom(options.SigningMethod)
 
 	if _, invalid := alg.(jwa.InvalidKeyAlgorithm); invalid {
-		return nil, fmt.Errorf("%s is not a valid key algorithm", j.cfg.Auth.JwtOptions.SigningMethod)
+		return nil, fmt.Errorf("%s is not a valid key algorithm", options.SigningMethod)
 	}
 
-	key, err := j.resolveKey()
+	key, err := resolveKey(options)
 
 	if err != nil {
 		return nil, errors.New(err.Error())
@@ -76,21 +83,21 @@ func (j *JwtService) Parse(authHeader string) (jwt.Token, error) {
 	return jwt.Parse([]byte(tokenString), jwt.WithKey(alg, key))
 }
 
-func (j *JwtService) resolveKey() (jwk.Key, error) {
-	keyBytes, err := j.resolveBytes()
+func resolveKey(options config.JwtOptions) (jwk.Key, error) {
+	keyBytes, err := resolveBytes(options)
 	if err != nil {
 		return nil, err
 	}
 	return jwk.ParseKey(keyBytes)
 }
 
-func (j *JwtService) resolveBytes() ([]byte, error) {
-	if j.cfg.Auth.JwtOptions.KeyUrl != "" {
-		return loadKeyFromUrl(j.cfg.Auth.JwtOptions.KeyUrl)
-	} else if j.cfg.Auth.JwtOptions.KeyPath != "" {
-		return loadKeyFromFile(j.cfg.Auth.JwtOptions.KeyPath)
-	} else if j.cfg.Auth.JwtOptions.Key != "" {
-		return []byte(j.cfg.Auth.JwtOptions.Key), nil
+func resolveBytes(options config.JwtOptions) ([]byte, error) {
+	if options.KeyUrl != "" {
+		return loadKeyFromUrl(options.KeyUrl)
+	} else if options.KeyPath != "" {
+		return loadKeyFromFile(options.KeyPath)
+	} else if options.Key != "" {
+		return []byte(options.Key), nil
 	} else {
 		return nil, errors.New("could not resolve JWT signing key")
 	}
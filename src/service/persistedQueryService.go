@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/patrickmn/go-cache"
+	"log"
+	"os"
+	"strings"
+)
+
+// The messages of the not found and not supported errors are the ones Apollo clients look for.
+var (
+	ErrPersistedQueryNotFound     = errors.New("PersistedQueryNotFound")
+	ErrPersistedQueryNotSupported = errors.New("PersistedQueryNotSupported")
+	ErrPersistedQueryHashMismatch = errors.New("provided sha does not match query")
+	ErrQueryNotAllowed            = errors.New("query is not in the persisted query manifest")
+)
+
+// persistedQueryManifest is the manifest format of Apollo, ids are the sha256 hashes of the bodies.
+type persistedQueryManifest struct {
+	Operations []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Body string `json:"body"`
+	} `json:"operations"`
+}
+
+// PersistedQueryService resolves the queries of persisted query hashes. Queries registered by
+// clients are kept in the cache, the queries of the manifest for as long as the agent runs.
+type PersistedQueryService struct {
+	cfg      config.PersistedQueryOptions
+	cache    *cache.Cache
+	manifest map[string]string
+}
+
+func NewPersistedQueryService(cfg config.Config, c *cache.Cache) (*PersistedQueryService, error) {
+	manifest := make(map[string]string)
+	if cfg.PersistedQueries.ManifestPath != "" {
+		var err error
+		manifest, err = loadManifest(cfg.PersistedQueries.ManifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load persisted query manifest: %w", err)
+		}
+		log.Printf("loaded %d persisted queries\n", len(manifest))
+	}
+
+	return &PersistedQueryService{
+		cfg:      cfg.PersistedQueries,
+		cache:    c,
+		manifest: manifest,
+	}, nil
+}
+
+func loadManifest(path string) (map[string]string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var content persistedQueryManifest
+	err = json.Unmarshal(bytes, &content)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make(map[string]string, len(content.Operations))
+	for _, operation := range content.Operations {
+		hash := HashQuery(operation.Body)
+		if !strings.EqualFold(operation.ID, hash) {
+			return nil, fmt.Errorf("id of operation %s is not the sha256 hash of its body", operation.Name)
+		}
+		manifest[hash] = operation.Body
+	}
+	return manifest, nil
+}
+
+// HashQuery returns the hex encoded sha256 hash of the query as used by persisted queries.
+func HashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+func persistedQueryCacheKey(hash string) string {
+	return "persistedQuery:" + hash
+}
+
+// Resolve returns the query of the request together with its hash, which is empty if persisted
+// queries are not configured. hash is the sha256Hash of the persistedQuery extension, a request
+// with a hash but without query is resolved from the manifest or the registered queries.
+func (s *PersistedQueryService) Resolve(query string, hash string) (string, string, error) {
+	if !s.cfg.Enabled && !s.cfg.AllowList {
+		if hash != "" {
+			return "", "", ErrPersistedQueryNotSupported
+		}
+		return query, "", nil
+	}
+
+	hash = strings.ToLower(hash)
+	if query != "" {
+		queryHash := HashQuery(query)
+		if hash != "" && hash != queryHash {
+			return "", "", ErrPersistedQueryHashMismatch
+		}
+		if s.cfg.AllowList {
+			if _, ok := s.manifest[queryHash]; !ok {
+				return "", "", ErrQueryNotAllowed
+			}
+		} else if hash != "" {
+			s.cache.Set(persistedQueryCacheKey(hash), query, cache.DefaultExpiration)
+		}
+		return query, queryHash, nil
+	}
+
+	if hash == "" {
+		return "", "", nil
+	}
+	if manifestQuery, ok := s.manifest[hash]; ok {
+		return manifestQuery, hash, nil
+	}
+	if s.cfg.AllowList {
+		return "", "", ErrQueryNotAllowed
+	}
+	if registered, found := s.cache.Get(persistedQueryCacheKey(hash)); found {
+		return registered.(string), hash, nil
+	}
+	return "", "", ErrPersistedQueryNotFound
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/patrickmn/go-cache"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	manifestQuery   = `query { me { name } }`
+	registeredQuery = `query { users { name } }`
+)
+
+func writeManifest(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		error   string
+	}{
+		{
+			name:    "valid",
+			content: `{"operations":[{"id":"` + HashQuery(manifestQuery) + `","name":"Me","body":"query { me { name } }"}]}`,
+		},
+		{
+			name:    "upper case id",
+			content: `{"operations":[{"id":"` + strings.ToUpper(HashQuery(manifestQuery)) + `","name":"Me","body":"query { me { name } }"}]}`,
+		},
+		{
+			name:    "id of another body",
+			content: `{"operations":[{"id":"` + HashQuery(registeredQuery) + `","name":"Me","body":"query { me { name } }"}]}`,
+			error:   "id of operation Me is not the sha256 hash of its body",
+		},
+		{
+			name:    "malformed",
+			content: `{"operations":`,
+			error:   "unexpected end of JSON input",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, err := loadManifest(writeManifest(t, test.content))
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("Expected error %q, got %v", test.error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest[HashQuery(manifestQuery)] != manifestQuery {
+				t.Fatalf("Expected the manifest to contain the query by its hash, got %v", manifest)
+			}
+		})
+	}
+}
+
+func TestPersistedQueryService_Resolve(t *testing.T) {
+	manifestPath := writeManifest(t, `{"operations":[{"id":"`+HashQuery(manifestQuery)+`","name":"Me","body":"query { me { name } }"}]}`)
+
+	tests := []struct {
+		name         string
+		options      config.PersistedQueryOptions
+		query        string
+		hash         string
+		expectedHash string
+		expected     string
+		error        error
+	}{
+		{
+			name:     "disabled without hash",
+			query:    registeredQuery,
+			expected: registeredQuery,
+		},
+		{
+			name:  "disabled with hash",
+			hash:  HashQuery(registeredQuery),
+			error: ErrPersistedQueryNotSupported,
+		},
+		{
+			name:         "query without hash",
+			options:      config.PersistedQueryOptions{Enabled: true},
+			query:        registeredQuery,
+			expected:     registeredQuery,
+			expectedHash: HashQuery(registeredQuery),
+		},
+		{
+			name:    "hash mismatch",
+			options: config.PersistedQueryOptions{Enabled: true},
+			query:   registeredQuery,
+			hash:    HashQuery(manifestQuery),
+			error:   ErrPersistedQueryHashMismatch,
+		},
+		{
+			name:    "unknown hash",
+			options: config.PersistedQueryOptions{Enabled: true},
+			hash:    HashQuery(registeredQuery),
+			error:   ErrPersistedQueryNotFound,
+		},
+		{
+			name:         "manifest hash",
+			options:      config.PersistedQueryOptions{Enabled: true, ManifestPath: manifestPath},
+			hash:         strings.ToUpper(HashQuery(manifestQuery)),
+			expected:     manifestQuery,
+			expectedHash: HashQuery(manifestQuery),
+		},
+		{
+			name:         "allow list with a manifest query",
+			options:      config.PersistedQueryOptions{AllowList: true, ManifestPath: manifestPath},
+			query:        manifestQuery,
+			expected:     manifestQuery,
+			expectedHash: HashQuery(manifestQuery),
+		},
+		{
+			name:    "allow list with another query",
+			options: config.PersistedQueryOptions{AllowList: true, ManifestPath: manifestPath},
+			query:   registeredQuery,
+			error:   ErrQueryNotAllowed,
+		},
+		{
+			name:    "allow list with another query and its hash",
+			options: config.PersistedQueryOptions{AllowList: true, ManifestPath: manifestPath},
+			query:   registeredQuery,
+			hash:    HashQuery(registeredQuery),
+			error:   ErrQueryNotAllowed,
+		},
+		{
+			name:    "allow list with an unknown hash",
+			options: config.PersistedQueryOptions{AllowList: true, ManifestPath: manifestPath},
+			hash:    HashQuery(registeredQuery),
+			error:   ErrQueryNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewPersistedQueryService(config.Config{PersistedQueries: test.options}, cache.New(cache.NoExpiration, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, hash, err := s.Resolve(test.query, test.hash)
+			if test.error != nil {
+				if !errors.Is(err, test.error) {
+					t.Fatalf("Expected error %v, got %v", test.error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != test.expected || hash != test.expectedHash {
+				t.Fatalf("Expected %q with hash %q, got %q with hash %q", test.expected, test.expectedHash, query, hash)
+			}
+		})
+	}
+}
+
+func TestPersistedQueryService_Resolve_Registered(t *testing.T) {
+	c := cache.New(cache.NoExpiration, 0)
+	s, err := NewPersistedQueryService(config.Config{PersistedQueries: config.PersistedQueryOptions{Enabled: true}}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := HashQuery(registeredQuery)
+
+	if _, _, err = s.Resolve("", hash); !errors.Is(err, ErrPersistedQueryNotFound) {
+		t.Fatalf("Expected the query not to be found before it is registered, got %v", err)
+	}
+	if _, _, err = s.Resolve(registeredQuery, hash); err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := s.Resolve("", hash)
+	if err != nil || query != registeredQuery {
+		t.Fatalf("Expected the registered query, got %q, %v", query, err)
+	}
+
+	c.Flush()
+	if _, _, err = s.Resolve("", hash); !errors.Is(err, ErrPersistedQueryNotFound) {
+		t.Fatalf("Expected the query not to be found once it expired, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-iam/agent/src/config"
+	"github.com/graphql-iam/agent/src/schema"
+	"github.com/graphql-iam/agent/src/upstream"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SchemaService holds the upstream schemas of the routes, loaded once at startup.
+type SchemaService struct {
+	schemas map[string]*graphql.Schema
+}
+
+func NewSchemaService(cfg config.Config, upstreamClient *upstream.Client) (*SchemaService, error) {
+	schemas := make(map[string]*graphql.Schema)
+	for _, route := range cfg.Routes {
+		s, err := loadSchema(route, upstreamClient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load schema of route %s: %w", route.Name, err)
+		}
+		if s != nil {
+			log.Printf("loaded schema of route %s\n", route.Name)
+			schemas[route.Name] = s
+		}
+	}
+
+	return &SchemaService{
+		schemas: schemas,
+	}, nil
+}
+
+// Schema returns the schema of the route, nil if none is configured.
+func (s *SchemaService) Schema(route string) *graphql.Schema {
+	return s.schemas[route]
+}
+
+func loadSchema(route config.Route, upstreamClient *upstream.Client) (*graphql.Schema, error) {
+	if route.Schema.Path != "" {
+		sdl, err := os.ReadFile(route.Schema.Path)
+		if err != nil {
+			return nil, err
+		}
+		return schema.FromSDL(string(sdl))
+	}
+	if route.Schema.Introspect {
+		return introspect(route, upstreamClient)
+	}
+	return nil, nil
+}
+
+func introspect(route config.Route, upstreamClient *upstream.Client) (*graphql.Schema, error) {
+	body, err := json.Marshal(map[string]string{"query": schema.IntrospectionQuery})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route.SourceUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range route.Schema.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := upstreamClient.Do(req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection returned status %d", res.StatusCode)
+	}
+
+	response, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return schema.FromIntrospection(response)
+}
@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/graphql-iam/agent/src/config"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Client sends requests to the upstream GraphQL server over a pooled transport shared by all requests.
+type Client struct {
+	cfg        config.UpstreamOptions
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+}
+
+func NewClient(cfg config.Config) (*Client, error) {
+	tlsConfig, err := newTlsConfig(cfg.Upstream.Tls)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(cfg.Upstream.DialTimeoutSec) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(cfg.Upstream.DialTimeoutSec) * time.Second,
+		ResponseHeaderTimeout: time.Duration(cfg.Upstream.ResponseHeaderTimeoutSec) * time.Second,
+		IdleConnTimeout:       time.Duration(cfg.Upstream.IdleConnTimeoutSec) * time.Second,
+		MaxIdleConns:          cfg.Upstream.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.Upstream.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.Upstream.MaxConnsPerHost,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &Client{
+		cfg: cfg.Upstream,
+		httpClient: &http.Client{
+			Transport: transport,
+			// an overall timeout would also cut off streamed responses, it is 0 unless configured
+			Timeout: time.Duration(cfg.Upstream.TimeoutSec) * time.Second,
+		},
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// TLSConfig returns the TLS settings for connections to the upstream, nil if none are configured.
+func (c *Client) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+// Do sends the request. If retryable is set, requests failing with a connection error are
+// retried up to the configured number of times. Only queries may be retried since the upstream
+// might have executed a mutation before the connection failed.
+func (c *Client) Do(req *http.Request, retryable bool) (*http.Response, error) {
+	res, err := c.httpClient.Do(req)
+	if !retryable || (req.Body != nil && req.GetBody == nil) {
+		return res, err
+	}
+
+	for attempt := 1; attempt <= c.cfg.Retries && err != nil && isConnectionError(err); attempt++ {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(time.Duration(attempt*100) * time.Millisecond):
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			retry.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("retrying upstream request after connection error, attempt %d\n", attempt)
+		res, err = c.httpClient.Do(retry)
+	}
+	return res, err
+}
+
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF)
+}
+
+func newTlsConfig(cfg config.TlsOptions) (*tls.Config, error) {
+	if cfg.CaPath == "" && cfg.CertPath == "" && cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CaPath != "" {
+		caBytes, err := os.ReadFile(cfg.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CaPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}